@@ -7,15 +7,32 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type Config struct {
 	targets      map[string]TargetCfg
-	measurements []MeasurementCfg
+	// by index, the indices of a registry are never reused across reloads
+	measurements map[uint]MeasurementCfg
 	portRangeMin uint64
 	portRangeMax uint64
 	baseWorkDir  string
 	powstreamCmd string
+	owpingCmd    string
+	stopTimeout  time.Duration
+	responder    ResponderCfg
+	reflector    ReflectorCfg
+	retention    RetentionCfg
+	// reports older than this are not exported (0 disables the expiry)
+	staleAfter time.Duration
+	staleMode  string
+	// number of sessions loaded from the work directories on startup
+	backfillSessions uint64
+	// file the registry state is persisted to (empty disables it)
+	stateFile     string
+	stateInterval time.Duration
+	// windows the recent sessions are aggregated over (none disables them)
+	windows []WindowCfg
 }
 
 type TargetCfg struct {
@@ -30,19 +47,42 @@ type MeasurementCfg struct {
 	targetDst   string
 	pps         uint64
 	duration    uint64
-	tags        []string
+	labels      map[string]string
 	bucketWidth string
 	promHistBins []float64
+	backend     string
+	protocol    string
+	port        uint64
+	stampTLVs   bool
+	replayDir   string
+	workDir     string
+	discovery   string
+	watchdogMissed uint64
 }
 
 func ParseConfig(r *bufio.Reader) (Config, error) {
 	var err error
 	ret := Config{
 		targets:      make(map[string]TargetCfg),
-		measurements: make([]MeasurementCfg, 0, 3),
+		measurements: make(map[uint]MeasurementCfg),
 		powstreamCmd: "powstream",
+		owpingCmd:    "owping",
+		stopTimeout:  10 * time.Second,
+		staleMode:    "omit",
+		backfillSessions: 1,
+		stateInterval: 5 * time.Minute,
 		portRangeMin: 9000,
 		portRangeMax: 9999,
+		responder: ResponderCfg{
+			listenAddr:     fmt.Sprintf(":%d", owampControlPort),
+			maxConnections: 64,
+			maxSessions:    64,
+			maxPackets:     100000,
+		},
+		reflector: ReflectorCfg{
+			listenAddr: fmt.Sprintf(":%d", twampControlPort),
+			syncSource: stampSyncSourceNTP,
+		},
 	}
 
 	s := bufio.NewScanner(r)
@@ -93,6 +133,140 @@ func ParseConfig(r *bufio.Reader) (Config, error) {
 			}
 			ret.targets[parts[1]] = target
 
+		case "RESPONDER":
+			if len(parts) < 2 {
+				return ret, errors.New("Config syntax error: RESPONDER <listen-address> [options]")
+			}
+
+			ret.responder.enabled = true
+			ret.responder.listenAddr = parts[1]
+			for _, option := range parts[2:] {
+				if suffix, found := strings.CutPrefix(option, "ports="); found {
+					portMin, portMax, found := strings.Cut(suffix, "-")
+					if !found {
+						return ret, errors.New("Config syntax error: RESPONDER ports=<min>-<max>")
+					}
+					if ret.responder.portRangeMin, err = strconv.ParseUint(portMin, 10, 16); err != nil {
+						return ret, errors.New("Config syntax error: RESPONDER ports min value not integer")
+					}
+					if ret.responder.portRangeMax, err = strconv.ParseUint(portMax, 10, 16); err != nil {
+						return ret, errors.New("Config syntax error: RESPONDER ports max value not integer")
+					}
+				}
+				if suffix, found := strings.CutPrefix(option, "max-connections="); found {
+					if ret.responder.maxConnections, err = strconv.ParseUint(suffix, 10, 64); err != nil {
+						return ret, errors.New("Config syntax error: RESPONDER max-connections value not integer")
+					}
+				}
+				if suffix, found := strings.CutPrefix(option, "max-sessions="); found {
+					if ret.responder.maxSessions, err = strconv.ParseUint(suffix, 10, 64); err != nil {
+						return ret, errors.New("Config syntax error: RESPONDER max-sessions value not integer")
+					}
+				}
+				if suffix, found := strings.CutPrefix(option, "max-packets="); found {
+					if ret.responder.maxPackets, err = strconv.ParseUint(suffix, 10, 64); err != nil {
+						return ret, errors.New("Config syntax error: RESPONDER max-packets value not integer")
+					}
+				}
+			}
+
+		case "REFLECTOR":
+			if len(parts) < 2 {
+				return ret, errors.New("Config syntax error: REFLECTOR <listen-address> [options]")
+			}
+
+			ret.reflector.enabled = true
+			ret.reflector.listenAddr = parts[1]
+			for _, option := range parts[2:] {
+				if suffix, found := strings.CutPrefix(option, "sync-source="); found {
+					syncSource, ok := stampSyncSources[suffix]
+					if !ok {
+						return ret, errors.New("Config syntax error: REFLECTOR sync-source must be ntp, ptp, gnss or free-running")
+					}
+					ret.reflector.syncSource = syncSource
+				}
+			}
+
+		case "RETENTION":
+			for _, option := range parts[1:] {
+				if option == "delete-after-parse" {
+					ret.retention.deleteAfterParse = true
+				} else if option == "compress" {
+					ret.retention.compress = true
+				} else if suffix, found := strings.CutPrefix(option, "archive-dir="); found {
+					ret.retention.archiveDir = suffix
+				} else if suffix, found := strings.CutPrefix(option, "keep-sessions="); found {
+					if ret.retention.keepSessions, err = strconv.ParseUint(suffix, 10, 64); err != nil {
+						return ret, errors.New("Config syntax error: RETENTION keep-sessions value not integer")
+					}
+				} else if suffix, found := strings.CutPrefix(option, "max-age="); found {
+					if ret.retention.maxAge, err = time.ParseDuration(suffix); err != nil {
+						return ret, errors.New("Config syntax error: RETENTION max-age value not a duration")
+					}
+				} else if suffix, found := strings.CutPrefix(option, "max-bytes="); found {
+					if ret.retention.maxBytes, err = strconv.ParseUint(suffix, 10, 64); err != nil {
+						return ret, errors.New("Config syntax error: RETENTION max-bytes value not integer")
+					}
+				} else {
+					return ret, errors.New("Config syntax error: RETENTION unknown option " + option)
+				}
+			}
+
+		case "BACKFILL":
+			if len(parts) != 2 {
+				return ret, errors.New("Config syntax error: BACKFILL <sessions>")
+			}
+			if ret.backfillSessions, err = strconv.ParseUint(parts[1], 10, 64); err != nil {
+				return ret, errors.New("Config syntax error: BACKFILL invalid int")
+			}
+
+		case "STATE-FILE":
+			if len(parts) < 2 {
+				return ret, errors.New("Config syntax error: STATE-FILE <path> [interval=<duration>]")
+			}
+			ret.stateFile = parts[1]
+			for _, option := range parts[2:] {
+				if suffix, found := strings.CutPrefix(option, "interval="); found {
+					if ret.stateInterval, err = time.ParseDuration(suffix); err != nil || ret.stateInterval <= 0 {
+						return ret, errors.New("Config syntax error: STATE-FILE interval value not a positive duration")
+					}
+				} else {
+					return ret, errors.New("Config syntax error: STATE-FILE unknown option " + option)
+				}
+			}
+
+		case "WINDOWS":
+			if len(parts) < 2 {
+				return ret, errors.New("Config syntax error: WINDOWS <duration> [<duration>...]")
+			}
+			ret.windows = ret.windows[:0]
+			for _, name := range parts[1:] {
+				length, err := time.ParseDuration(name)
+				if err != nil || length <= 0 {
+					return ret, errors.New("Config syntax error: WINDOWS value not a positive duration")
+				}
+				for _, window := range ret.windows {
+					if window.name == name {
+						return ret, errors.New("Config syntax error: WINDOWS duplicate window " + name)
+					}
+				}
+				ret.windows = append(ret.windows, WindowCfg{name: name, length: length})
+			}
+
+		case "STALE-AFTER":
+			if len(parts) < 2 || len(parts) > 3 {
+				return ret, errors.New("Config syntax error: STALE-AFTER <duration> [omit|down]")
+			}
+			if ret.staleAfter, err = time.ParseDuration(parts[1]); err != nil {
+				return ret, errors.New("Config syntax error: STALE-AFTER invalid duration")
+			}
+			if len(parts) == 3 {
+				if parts[2] != "omit" && parts[2] != "down" {
+					return ret, errors.New("Config syntax error: STALE-AFTER mode must be omit or down")
+				}
+				ret.staleMode = parts[2]
+			}
+
 		case "DEFAULT-PPS":
 			if len(parts) != 2 {
 				return ret, errors.New("Config syntax error: DEFAULT-PPS <pps-value>")
@@ -154,12 +328,16 @@ func ParseConfig(r *bufio.Reader) (Config, error) {
 				pps:         defaultPPS,
 				duration:    defaultDuration,
 				bucketWidth: defaultBucketWidth,
-				tags: []string{
-					fmt.Sprintf("src_short_name=\"%s\"", parts[1]),
-					fmt.Sprintf("dst_short_name=\"%s\"", parts[2]),
-					fmt.Sprintf("src_hostname=\"%s\"", ret.targets[parts[1]].hostname),
-					fmt.Sprintf("dst_hostname=\"%s\"", ret.targets[parts[2]].hostname),
-					fmt.Sprintf("afi=\"%s\"", afi),
+				backend:     "powstream",
+				discovery:   "stdout",
+				watchdogMissed: 3,
+				protocol:    "owamp",
+				labels: map[string]string{
+					"src_short_name": parts[1],
+					"dst_short_name": parts[2],
+					"src_hostname":   ret.targets[parts[1]].hostname,
+					"dst_hostname":   ret.targets[parts[2]].hostname,
+					"afi":            afi,
 				},
 			}
 			for _, option := range parts[3:] {
@@ -171,6 +349,45 @@ func ParseConfig(r *bufio.Reader) (Config, error) {
 				if suffix, found := strings.CutPrefix(option, "bucketwidth="); found {
 					measurement.bucketWidth = suffix
 				}
+				if suffix, found := strings.CutPrefix(option, "backend="); found {
+					if _, ok := measurementBackends[suffix]; !ok {
+						return ret, errors.New("Config syntax error: MEASUREMENT unknown backend " + suffix)
+					}
+					measurement.backend = suffix
+				}
+				if suffix, found := strings.CutPrefix(option, "protocol="); found {
+					if suffix != "owamp" && suffix != "twamp" && suffix != "twamp-light" && suffix != "stamp" {
+						return ret, errors.New("Config syntax error: MEASUREMENT protocol must be owamp, twamp, twamp-light or stamp")
+					}
+					measurement.protocol = suffix
+				}
+				if suffix, found := strings.CutPrefix(option, "port="); found {
+					if measurement.port, err = strconv.ParseUint(suffix, 10, 16); err != nil {
+						return ret, errors.New("Config syntax error: MEASUREMENT port value not integer")
+					}
+				}
+				if suffix, found := strings.CutPrefix(option, "watchdog-missed-sessions="); found {
+					if measurement.watchdogMissed, err = strconv.ParseUint(suffix, 10, 64); err != nil {
+						return ret, errors.New("Config syntax error: MEASUREMENT watchdog-missed-sessions value not integer")
+					}
+				}
+				if suffix, found := strings.CutPrefix(option, "workdir="); found {
+					measurement.workDir = suffix
+				}
+				if suffix, found := strings.CutPrefix(option, "discovery="); found {
+					if suffix != "stdout" && suffix != "watch" {
+						return ret, errors.New("Config syntax error: MEASUREMENT discovery must be stdout or watch")
+					}
+					measurement.discovery = suffix
+				}
+				if suffix, found := strings.CutPrefix(option, "replay-dir="); found {
+					measurement.replayDir = suffix
+				}
+				if suffix, found := strings.CutPrefix(option, "stamp-tlvs="); found {
+					if measurement.stampTLVs, err = strconv.ParseBool(suffix); err != nil {
+						return ret, errors.New("Config syntax error: MEASUREMENT stamp-tlvs value not boolean")
+					}
+				}
 				if suffix, found := strings.CutPrefix(option, "hist-min-latency="); found {
 					if histMinLatency, err = strconv.ParseUint(suffix, 10, 64); err != nil {
 						return ret, errors.New("Config syntax error: MEASUREMENT hist-min-latency value not integer")
@@ -183,10 +400,31 @@ func ParseConfig(r *bufio.Reader) (Config, error) {
 				}
 
 			}
+			// the two-way protocols are only implemented by the native backend
+			if measurement.protocol != "owamp" && measurement.backend == "powstream" {
+				measurement.backend = "native"
+			}
+			if measurement.protocol != "owamp" && measurement.backend != "native" && measurement.backend != "replay" {
+				return ret, errors.New("Config syntax error: MEASUREMENT protocol " + measurement.protocol + " requires the native backend")
+			}
+			// the native backend derives the interval of the test packets from the rate
+			if measurement.backend == "native" && measurement.pps == 0 {
+				return ret, errors.New("Config syntax error: MEASUREMENT backend native requires pps greater than 0")
+			}
+			if measurement.backend == "replay" && measurement.replayDir == "" {
+				return ret, errors.New("Config syntax error: MEASUREMENT backend replay requires replay-dir")
+			}
+			measurement.labels["protocol"] = measurement.protocol
 			measurement.promHistBins = MakePromHistBins(histMinLatency, histMaxLatency, histMaxLinearLatency, histLinearPtsPerMs, histLogPts)
-			ret.measurements = append(ret.measurements, measurement)
+			ret.measurements[uint(len(ret.measurements))] = measurement
 		}
 
 	}
+
+	// the responder uses the test port range of the measurements unless configured otherwise
+	if ret.responder.portRangeMin == 0 || ret.responder.portRangeMax == 0 {
+		ret.responder.portRangeMin = ret.portRangeMin
+		ret.responder.portRangeMax = ret.portRangeMax
+	}
 	return ret, nil
 }
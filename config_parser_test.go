@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func TestParseConfigPPS(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      string
+		errExpected bool
+	}{
+		{"native", "MEASUREMENT a b backend=native pps=5", false},
+		{"native without rate", "MEASUREMENT a b backend=native pps=0", true},
+		{"native with zero default", "DEFAULT-PPS 0\nMEASUREMENT a b backend=native", true},
+		{"twamp without rate", "MEASUREMENT a b protocol=twamp pps=0", true},
+		{"twamp-light without rate", "MEASUREMENT a b protocol=twamp-light pps=0", true},
+		{"stamp without rate", "MEASUREMENT a b protocol=stamp pps=0", true},
+	}
+	for _, tt := range tests {
+		config := "TARGET a 192.0.2.1 local\nTARGET b 192.0.2.2\n" + tt.config + "\n"
+		_, err := ParseConfig(bufio.NewReader(strings.NewReader(config)))
+		if (err != nil) != tt.errExpected {
+			t.Errorf("%s: error = %v, want error %v", tt.name, err, tt.errExpected)
+		}
+	}
+}
+
+func TestParseConfigProtocolLabel(t *testing.T) {
+	tests := []struct {
+		options  string
+		protocol string
+	}{
+		{"", "owamp"},
+		{"backend=native", "owamp"},
+		{"protocol=twamp", "twamp"},
+		{"protocol=stamp", "stamp"},
+	}
+	for _, tt := range tests {
+		config := "TARGET a 192.0.2.1 local\nTARGET b 192.0.2.2\nMEASUREMENT a b " + tt.options + "\n"
+		cfg, err := ParseConfig(bufio.NewReader(strings.NewReader(config)))
+		if err != nil {
+			t.Fatalf("%q: %v", tt.options, err)
+		}
+		if got := cfg.measurements[0].labels["protocol"]; got != tt.protocol {
+			t.Errorf("%q: protocol label %q, want %q", tt.options, got, tt.protocol)
+		}
+	}
+}
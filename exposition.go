@@ -0,0 +1,258 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// metadata of the exported metrics and their collection as const metrics
+//
+// Info metrics are exposed as gauges, client_golang has no info type.
+
+const (
+	metricGauge     = "gauge"
+	metricCounter   = "counter"
+	metricHistogram = "histogram"
+	metricInfo      = "info"
+	metricUntyped   = "untyped"
+)
+
+type metricDesc struct {
+	name string
+	typ  string
+	// only set if the name ends with the unit
+	unit string
+	help string
+}
+
+var metricDescs = []metricDesc{
+	// freshness of the measurements
+	{"owamp_last_session_age_seconds", metricGauge, "seconds", "Time since the end of the last measurement session."},
+	{"owamp_up", metricGauge, "", "Whether the last measurement session is recent."},
+
+	// last measurement session
+	{"owamp_start_time", metricGauge, "", "Start of the measurement session in seconds since the epoch."},
+	{"owamp_end_time", metricGauge, "", "End of the measurement session in seconds since the epoch."},
+	// named after the session, owamp_packets_sent etc. are the OpenMetrics families of the counters
+	{"owamp_session_packets_sent", metricGauge, "", "Number of packets sent during the measurement session."},
+	{"owamp_session_packets_dup", metricGauge, "", "Number of duplicate packets received during the measurement session."},
+	{"owamp_session_packets_lost", metricGauge, "", "Number of packets lost during the measurement session."},
+	{"owamp_latency", metricHistogram, "", "One-way latency histogram of the measurement session in seconds."},
+	{"owamp_latency_min", metricGauge, "", "Minimum one-way latency of the measurement session in seconds."},
+	{"owamp_latency_median", metricGauge, "", "Median one-way latency of the measurement session in seconds."},
+	{"owamp_latency_max", metricGauge, "", "Maximum one-way latency of the measurement session in seconds."},
+	{"owamp_ttl", metricHistogram, "", "Packet TTL histogram of the measurement session."},
+	{"owamp_reordering", metricHistogram, "", "Histogram of the reordering events of the measurement session."},
+	{"owamp_ttl_packets", metricGauge, "", "Number of packets received with the TTL during the measurement session."},
+	{"owamp_reordering_packets", metricGauge, "", "Number of n-reordered packets of the measurement session."},
+	{"owamp_time_error_estimate", metricGauge, "", "Estimate of the uncertainty of the absolute time calibration in seconds."},
+	{"owamp_twoway_latency", metricHistogram, "", "Round-trip latency histogram of the measurement session in seconds."},
+	{"owamp_twoway_latency_min", metricGauge, "", "Minimum round-trip latency of the measurement session in seconds."},
+	{"owamp_twoway_latency_median", metricGauge, "", "Median round-trip latency of the measurement session in seconds."},
+	{"owamp_twoway_latency_max", metricGauge, "", "Maximum round-trip latency of the measurement session in seconds."},
+	{"owamp_reverse_latency_min", metricGauge, "", "Minimum one-way latency from the reflector back to the source in seconds."},
+	{"owamp_reverse_latency_median", metricGauge, "", "Median one-way latency from the reflector back to the source in seconds."},
+	{"owamp_reverse_latency_max", metricGauge, "", "Maximum one-way latency from the reflector back to the source in seconds."},
+	{"owamp_stamp_tlv_packets", metricGauge, "", "Number of reflected packets carrying STAMP TLVs."},
+	{"owamp_stamp_tlv_unrecognized", metricGauge, "", "Number of STAMP TLVs flagged as unrecognized by the reflector."},
+	{"owamp_stamp_tlv_malformed", metricGauge, "", "Number of malformed STAMP TLVs."},
+	{"owamp_stamp_reflector_sync_source", metricGauge, "", "Clock synchronization source reported by the STAMP reflector."},
+	{"owamp_stamp_reflector_timestamp_method", metricGauge, "", "Timestamping method reported by the STAMP reflector."},
+	{"owamp_session_info", metricInfo, "", "Information about the measurement session."},
+	{"owamp_clock_sync", metricGauge, "", "Whether both hosts reported synchronized clocks during the measurement session."},
+	{"owamp_session_finished", metricGauge, "", "Whether the measurement session was completed."},
+	{"owamp_session_packets", metricGauge, "", "Number of packets scheduled for the measurement session."},
+	{"owamp_sample_packets", metricGauge, "", "Number of packets included in the summary."},
+	{"owamp_packets_errors", metricGauge, "", "Number of packets with errors during the measurement session."},
+	{"owamp_dscp", metricGauge, "", "DSCP value of the test packets."},
+	{"owamp_packet_padding_bytes", metricGauge, "bytes", "Padding length of the test packets."},
+	{"owamp_loss_timeout_seconds", metricGauge, "seconds", "Time after which a packet was considered lost."},
+	{"owamp_latency_pdv", metricGauge, "", "Packet delay variation as reported in the summary in seconds."},
+	{"owamp_ttl_min", metricGauge, "", "Minimum TTL of the received packets."},
+	{"owamp_ttl_max", metricGauge, "", "Maximum TTL of the received packets."},
+	{"owamp_summary_unknown_keys", metricGauge, "", "Number of keys in the summary not understood by the exporter."},
+	{"owamp_summary_section_value", metricGauge, "", "Value of a summary section table without a dedicated metric."},
+	{"owamp_latency_negative_packets", metricGauge, "", "Number of packets with a negative one-way latency."},
+	{"owamp_latency_negative_ratio", metricGauge, "", "Fraction of received packets with a negative one-way latency."},
+
+	// accumulated over all measurement sessions
+	{"owamp_sessions_total", metricCounter, "", "Number of measurement sessions."},
+	{"owamp_packets_sent_total", metricCounter, "", "Number of packets sent in all measurement sessions."},
+	{"owamp_packets_lost_total", metricCounter, "", "Number of packets lost in all measurement sessions."},
+	{"owamp_packets_duplicate_total", metricCounter, "", "Number of duplicate packets received in all measurement sessions."},
+	{"owamp_latency_cumulative", metricHistogram, "", "One-way latency histogram of all measurement sessions in seconds."},
+
+	// aggregated over the sessions in a sliding window
+	{"owamp_window_sessions", metricGauge, "", "Number of measurement sessions in the window."},
+	{"owamp_window_packets_sent", metricGauge, "", "Number of packets sent in the window."},
+	{"owamp_window_packets_lost", metricGauge, "", "Number of packets lost in the window."},
+	{"owamp_window_packets_dup", metricGauge, "", "Number of duplicate packets received in the window."},
+	{"owamp_window_loss_ratio", metricGauge, "", "Fraction of the packets sent in the window which were lost."},
+	{"owamp_window_latency", metricHistogram, "", "One-way latency histogram of the sessions in the window in seconds."},
+	{"owamp_window_latency_min", metricGauge, "", "Minimum one-way latency in the window in seconds."},
+	{"owamp_window_latency_median", metricGauge, "", "Median one-way latency in the window in seconds."},
+	{"owamp_window_latency_max", metricGauge, "", "Maximum one-way latency in the window in seconds."},
+	{"owamp_window_latency_quantile", metricGauge, "", "Quantiles of the one-way latency in the window in seconds."},
+
+	// per-packet data of the last measurement session
+	{"owamp_ipdv_mean", metricGauge, "", "Mean absolute inter-packet delay variation in seconds."},
+	{"owamp_ipdv_p95", metricGauge, "", "95th percentile of the absolute inter-packet delay variation in seconds."},
+	{"owamp_ipdv_p99", metricGauge, "", "99th percentile of the absolute inter-packet delay variation in seconds."},
+	{"owamp_pdv_mean", metricGauge, "", "Mean packet delay variation relative to the minimum delay in seconds."},
+	{"owamp_pdv_p95", metricGauge, "", "95th percentile of the packet delay variation relative to the minimum delay in seconds."},
+	{"owamp_pdv_p99", metricGauge, "", "99th percentile of the packet delay variation relative to the minimum delay in seconds."},
+	{"owamp_loss_episodes", metricGauge, "", "Number of loss episodes during the measurement session."},
+	{"owamp_loss_burst_length_mean", metricGauge, "", "Mean number of packets lost per loss episode."},
+	{"owamp_loss_burst_length_max", metricGauge, "", "Number of packets lost in the longest loss episode."},
+	{"owamp_loss_run_length", metricHistogram, "", "Histogram of the loss episode lengths in packets."},
+
+	// state of the measurement workers
+	{"owamp_summary_parse_errors_total", metricCounter, "", "Number of session files (summaries and .owp files) which failed to parse."},
+	{"owamp_worker_up", metricGauge, "", "Whether the measurement process is running."},
+	{"owamp_worker_restarts_total", metricCounter, "", "Number of times the measurement process was restarted."},
+	{"owamp_worker_last_exit_code", metricGauge, "", "Exit code of the last run of the measurement process."},
+	{"owamp_worker_missed_sessions_total", metricCounter, "", "Number of sessions without a summary in time."},
+	{"owamp_worker_exits_total", metricCounter, "", "Number of exits of the measurement process."},
+	{"owamp_workdir_files", metricGauge, "", "Number of session files in the directory."},
+	{"owamp_workdir_bytes", metricGauge, "bytes", "Total size of the session files in the directory."},
+
+	// built-in OWAMP server
+	{"owamp_responder_connections_total", metricCounter, "", "Number of control connections accepted."},
+	{"owamp_responder_connections_active", metricGauge, "", "Number of currently open control connections."},
+	{"owamp_responder_sessions_total", metricCounter, "", "Number of test sessions accepted."},
+	{"owamp_responder_sessions_active", metricGauge, "", "Number of currently running test sessions."},
+	{"owamp_responder_sessions_rejected_total", metricCounter, "", "Number of test session requests rejected."},
+	{"owamp_responder_packets_received_total", metricCounter, "", "Number of test packets received."},
+	{"owamp_responder_packets_sent_total", metricCounter, "", "Number of test packets sent."},
+	{"owamp_responder_packets_malformed_total", metricCounter, "", "Number of invalid test packets received."},
+	{"owamp_responder_control_errors_total", metricCounter, "", "Number of control connections terminated due to protocol errors."},
+
+	// built-in STAMP reflector
+	{"owamp_stamp_reflector_packets_total", metricCounter, "", "Number of test packets reflected."},
+	{"owamp_stamp_reflector_packets_malformed_total", metricCounter, "", "Number of invalid test packets received."},
+	{"owamp_stamp_reflector_tlv_unrecognized_total", metricCounter, "", "Number of TLVs returned with the unrecognized flag set."},
+
+	// configuration reloads
+	{"owamp_config_reloads_total", metricCounter, "", "Number of configuration reloads attempted."},
+	{"owamp_config_reload_failures_total", metricCounter, "", "Number of configuration reloads which failed."},
+	{"owamp_config_last_reload_successful", metricGauge, "", "Whether the last configuration reload succeeded."},
+}
+
+var metricDescIdx = make(map[string]int)
+
+func init() {
+	for i, desc := range metricDescs {
+		metricDescIdx[desc.name] = i
+	}
+}
+
+// the metadata of a family, the parts of VictoriaMetrics histograms (_bucket, _sum, _count) are untyped
+func lookupMetricDesc(name string) metricDesc {
+	if idx, found := metricDescIdx[name]; found {
+		return metricDescs[idx]
+	}
+	for _, part := range []string{"_bucket", "_sum", "_count"} {
+		if idx, found := metricDescIdx[strings.TrimSuffix(name, part)]; found {
+			return metricDesc{name: name, typ: metricUntyped, help: metricDescs[idx].help}
+		}
+	}
+	return metricDesc{name: name, typ: metricUntyped, help: name}
+}
+
+func (d metricDesc) valueType() prometheus.ValueType {
+	switch d.typ {
+	case metricCounter:
+		return prometheus.CounterValue
+	case metricGauge, metricInfo:
+		return prometheus.GaugeValue
+	}
+	return prometheus.UntypedValue
+}
+
+// sends the samples as const metrics to a collection
+type metricEmitter struct {
+	ch chan<- prometheus.Metric
+}
+
+// labels with the additional name/value pairs added
+func withLabels(labels prometheus.Labels, pairs ...string) prometheus.Labels {
+	if len(pairs) == 0 {
+		return labels
+	}
+	ret := make(prometheus.Labels, len(labels)+len(pairs)/2)
+	for name, value := range labels {
+		ret[name] = value
+	}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		ret[pairs[i]] = pairs[i+1]
+	}
+	return ret
+}
+
+func (me metricEmitter) send(m prometheus.Metric, err error, desc *prometheus.Desc, timestamp time.Time) {
+	if err != nil {
+		me.ch <- prometheus.NewInvalidMetric(desc, err)
+		return
+	}
+	if !timestamp.IsZero() {
+		m = prometheus.NewMetricWithTimestamp(timestamp, m)
+	}
+	me.ch <- m
+}
+
+// add a sample without timestamp, pairs are additional label names and values
+func (me metricEmitter) add(name string, labels prometheus.Labels, value float64, pairs ...string) {
+	me.addAt(name, labels, value, time.Time{}, pairs...)
+}
+
+// add a sample with a timestamp, pairs are additional label names and values
+func (me metricEmitter) addAt(name string, labels prometheus.Labels, value float64, timestamp time.Time, pairs ...string) {
+	md := lookupMetricDesc(name)
+	desc := prometheus.NewDesc(md.name, md.help, nil, withLabels(labels, pairs...))
+	m, err := prometheus.NewConstMetric(desc, md.valueType(), value)
+	me.send(m, err, desc, timestamp)
+}
+
+// add a histogram with the cumulative bucket counts by upper bound (without +Inf)
+func (me metricEmitter) histogramAt(name string, labels prometheus.Labels, count uint64, sum float64, buckets map[float64]uint64, timestamp time.Time) {
+	md := lookupMetricDesc(name)
+	desc := prometheus.NewDesc(md.name, md.help, nil, labels)
+	m, err := prometheus.NewConstHistogram(desc, count, sum, buckets)
+	me.send(m, err, desc, timestamp)
+}
+
+// serve the metrics in the format negotiated with the scraper (Prometheus text, OpenMetrics or protobuf),
+// unlike promhttp the OpenMetrics output carries the units of the families
+func metricsHandler(gatherer prometheus.Gatherer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mfs, err := gatherer.Gather()
+		if err != nil {
+			// still serve the metrics which could be collected
+			log.Printf("failed to collect metrics: %v", err)
+		}
+
+		format := expfmt.NegotiateIncludingOpenMetrics(req.Header)
+		w.Header().Set("Content-Type", string(format))
+		enc := expfmt.NewEncoder(w, format, expfmt.WithUnit())
+		for _, mf := range mfs {
+			if md := lookupMetricDesc(mf.GetName()); md.unit != "" {
+				unit := md.unit
+				mf.Unit = &unit
+			}
+			if err := enc.Encode(mf); err != nil {
+				log.Printf("failed to write metrics: %v", err)
+				return
+			}
+		}
+		if closer, ok := enc.(expfmt.Closer); ok {
+			if err := closer.Close(); err != nil {
+				log.Printf("failed to write metrics: %v", err)
+			}
+		}
+	})
+}
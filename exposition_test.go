@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// collector sending the samples written by f
+type testCollector struct {
+	f func(me metricEmitter)
+}
+
+func (c testCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+func (c testCollector) Collect(ch chan<- prometheus.Metric) {
+	c.f(metricEmitter{ch: ch})
+}
+
+// scrape the handler serving the samples written by f with the given Accept header
+func scrapeTestMetrics(t *testing.T, accept string, f func(me metricEmitter)) (string, string) {
+	t.Helper()
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(testCollector{f})
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	rec := httptest.NewRecorder()
+	metricsHandler(reg).ServeHTTP(rec, req)
+	body, err := io.ReadAll(rec.Result().Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rec.Result().Header.Get("Content-Type"), string(body)
+}
+
+func writeTestMetrics(me metricEmitter) {
+	labels := prometheus.Labels{"src": "a", "dst": "b"}
+	me.add("owamp_session_packets_sent", labels, 100)
+	me.add("owamp_sessions_total", labels, 3)
+	me.add("owamp_last_session_age_seconds", labels, 12.5)
+	me.histogramAt("owamp_latency", labels, 10, 0.01, map[float64]uint64{0.001: 4, 0.002: 10}, time.Time{})
+	me.add("owamp_latency_cumulative_bucket", labels, 10, "vmrange", "1.000e-03...1.136e-03")
+}
+
+func TestMetricsHandlerNegotiation(t *testing.T) {
+	tests := []struct {
+		name        string
+		accept      string
+		contentType string
+		lines       []string
+		eof         bool
+	}{
+		{"default", "", "text/plain; version=0.0.4", []string{
+			"# HELP owamp_session_packets_sent Number of packets sent during the measurement session.",
+			"# TYPE owamp_session_packets_sent gauge",
+			`owamp_session_packets_sent{dst="b",src="a"} 100`,
+			"# TYPE owamp_sessions_total counter",
+			"# TYPE owamp_latency histogram",
+			`owamp_latency_bucket{dst="b",src="a",le="0.001"} 4`,
+			"# TYPE owamp_latency_cumulative_bucket untyped",
+		}, false},
+		{"prometheus text", "text/plain;version=0.0.4;q=0.5,*/*;q=0.1", "text/plain; version=0.0.4", []string{
+			"# TYPE owamp_session_packets_sent gauge",
+		}, false},
+		{"openmetrics", "application/openmetrics-text; version=1.0.0", "application/openmetrics-text; version=1.0.0", []string{
+			"# HELP owamp_session_packets_sent Number of packets sent during the measurement session.",
+			`owamp_session_packets_sent{dst="b",src="a"} 100.0`,
+			// the counter family is named without the suffix
+			"# TYPE owamp_sessions counter",
+			`owamp_sessions_total{dst="b",src="a"} 3.0`,
+			"# UNIT owamp_last_session_age_seconds seconds",
+			"# TYPE owamp_latency_cumulative_bucket unknown",
+		}, true},
+	}
+
+	for _, tt := range tests {
+		contentType, body := scrapeTestMetrics(t, tt.accept, writeTestMetrics)
+		if !strings.HasPrefix(contentType, tt.contentType) {
+			t.Errorf("%s: content type %q, want %q", tt.name, contentType, tt.contentType)
+		}
+		lines := strings.Split(body, "\n")
+		for _, want := range tt.lines {
+			found := false
+			for _, line := range lines {
+				found = found || line == want
+			}
+			if !found {
+				t.Errorf("%s: missing line %q in\n%s", tt.name, want, body)
+			}
+		}
+		if eof := strings.HasSuffix(body, "# EOF\n"); eof != tt.eof {
+			t.Errorf("%s: terminated by # EOF: %v, want %v", tt.name, eof, tt.eof)
+		}
+	}
+}
+
+// every family has metadata, so no HELP falls back to the metric name
+func TestMetricDescs(t *testing.T) {
+	seen := make(map[string]bool)
+	for _, desc := range metricDescs {
+		if seen[desc.name] {
+			t.Errorf("%s described twice", desc.name)
+		}
+		seen[desc.name] = true
+		if desc.help == "" || desc.typ == "" {
+			t.Errorf("%s has no help or type", desc.name)
+		}
+		if desc.unit != "" && !strings.HasSuffix(desc.name, "_"+desc.unit) {
+			t.Errorf("%s does not end with its unit %s", desc.name, desc.unit)
+		}
+		if (desc.typ == metricCounter) != strings.HasSuffix(desc.name, "_total") {
+			t.Errorf("%s of type %s has the wrong suffix", desc.name, desc.typ)
+		}
+	}
+
+	// OpenMetrics names the family of a counter without the suffix, it must not be taken by another metric
+	for _, desc := range metricDescs {
+		if family, found := strings.CutSuffix(desc.name, "_total"); found && seen[family] {
+			t.Errorf("family %s of %s clashes with another metric", family, desc.name)
+		}
+	}
+
+	if md := lookupMetricDesc("owamp_window_latency_count"); md.typ != metricUntyped || md.help != lookupMetricDesc("owamp_window_latency").help {
+		t.Errorf("VictoriaMetrics histogram part described as %+v", md)
+	}
+}
+
+// the section tables of the summary are exported with one sample per value
+func TestRegistrySummaryTables(t *testing.T) {
+	summary, err := ParseSummary(bufio.NewReader(strings.NewReader(testSummary)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := testReloadConfig(1)
+	mcfg := cfg.measurements[0]
+	mcfg.promHistBins = MakePromHistBins(1, 1000, 50, 4, 5)
+	cfg.measurements[0] = mcfg
+	r := NewRegistry(cfg)
+	r.reports[0] = MeasurementReport{measurementIdx: 0, metricsTimestamp: summary.endTime, summary: &summary}
+
+	_, body := scrapeTestMetrics(t, "", func(me metricEmitter) { r.Collect(me.ch) })
+	for _, want := range []string{
+		`owamp_summary_section_value{column="1",key="1",section="newsection"} 2 `,
+		`owamp_summary_section_value{column="2",key="4",section="newsection"} 6 `,
+		`owamp_ttl_packets{ttl="64"} 98 `,
+		`owamp_reordering_packets{n="1"} 2 `,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing sample %q in\n%s", want, body)
+		}
+	}
+}
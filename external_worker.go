@@ -0,0 +1,27 @@
+package main
+
+import (
+	"context"
+)
+
+// measurement backend picking up the session files of a powstream instance
+// managed outside of the exporter (e.g. by systemd)
+//
+// The files are discovered in the work directory of the measurement and
+// handled like those of the powstream backend (quarantine and retention).
+
+type ExternalWorker struct {
+	*Worker
+}
+
+func NewExternalWorker(cfg Config, idx uint, outCh chan MeasurementReport) *ExternalWorker {
+	return &ExternalWorker{NewWorker(cfg, idx, outCh)}
+}
+
+func (w *ExternalWorker) RunWorker(ctx context.Context) {
+	w.retention.refresh()
+	w.backfill()
+	// there is no process to supervise, up means the directory is being watched
+	w.status.setUp()
+	w.newWatcher().Run(ctx)
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
-	"bufio"
 	"fmt"
 	"math"
 	"sort"
 	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // prometheus histogram code written from scratch
@@ -13,8 +15,8 @@ import (
 // VictoriaMetrics code based on https://github.com/VictoriaMetrics/metrics/blob/master/histogram.go
 // which is licensed under MIT and authored by valyala, tenmozes, hagen1778
 
-// dump out histogram in prometheus style
-func WriteHistogramPrometheus(w *bufio.Writer, name string, tags string, timestamp uint64, histo []HistogramEntry, scale float64, histBins []float64) error {
+// dump out histogram in prometheus style, the upper bounds are the configured bins (the last one is +Inf)
+func WriteHistogramPrometheus(me metricEmitter, name string, labels prometheus.Labels, timestamp time.Time, histo []HistogramEntry, scale float64, histBins []float64) {
 	// create sorted copy of input histogram
 	chist := make([]HistogramEntry, len(histo))
 	_ = copy(chist, histo)
@@ -22,64 +24,42 @@ func WriteHistogramPrometheus(w *bufio.Writer, name string, tags string, timesta
 		return chist[i].key < chist[j].key
 	})
 
-	// create output histogram matching the precomputed histogram bins
-	hist := make([]HistogramEntry, len(histBins))
-	for i := 0; i < len(histBins); i++ {
-		hist[i].key = uint64(histBins[i] / scale)
-		hist[i].value = 0
-	}
+	// cumulative counts in the order of the histogram bins
+	counts := make([]uint64, len(histBins))
 
 	// rebin onto new histogram bins
 	var cumsum float64 = 0.0
-	var j uint64 = 0
-	
+	var j int = 0
+
 	for _, entry := range chist {
 		curBin := scale * float64(entry.key)
 
 		cumsum += float64(entry.value) * float64(entry.key) * scale
-		
-		// advance pointer to new histogram until next increment 
-		for (j+1 < uint64(len(hist))) && (curBin > histBins[j]) {
-			hist[j+1].value = hist[j].value
+
+		// advance pointer to new histogram until next increment
+		for (j+1 < len(counts)) && (curBin > histBins[j]) {
+			counts[j+1] = counts[j]
 			j++
 		}
 
-		hist[j].value += entry.value
+		counts[j] += entry.value
 	}
 
 	// fill up the remaining histogram
-	for j+1 < uint64(len(hist)) {
-		hist[j+1].value = hist[j].value
+	for j+1 < len(counts) {
+		counts[j+1] = counts[j]
 		j++
 	}
 
-	for i, entry := range hist {
-		var le string
-		if (i + 1) < len(hist) {
-			le = fmt.Sprintf("%e", float64(entry.key)*scale)
-		} else {
-			le = "+Inf"
-		}
-		line := fmt.Sprintf("%s_bucket{%s,le=\"%s\"} %d %d\n", name, tags, le, entry.value, timestamp)
-		_, err := w.WriteString(line)
-		if err != nil {
-			return err
+	// the bins are increasing, a bin not above the previous one is left out rather than merged
+	buckets := make(map[float64]uint64, len(counts))
+	for i, count := range counts[:len(counts)-1] {
+		if i > 0 && histBins[i] <= histBins[i-1] {
+			continue
 		}
+		buckets[histBins[i]] = count
 	}
-
-	line := fmt.Sprintf("%s_sum{%s} %e %d\n", name, tags, cumsum, timestamp)
-	_, err := w.WriteString(line)
-	if err != nil {
-		return err
-	}
-
-	line = fmt.Sprintf("%s_count{%s} %d %d\n", name, tags, hist[len(hist)-1].value, timestamp)
-	_, err = w.WriteString(line)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	me.histogramAt(name, labels, counts[len(counts)-1], cumsum, buckets, timestamp)
 }
 
 // generate histogram bins to use for prometheus later
@@ -88,8 +68,9 @@ func MakePromHistBins(histMinLatency uint64, histMaxLatency uint64, histMaxLinea
 	ret := make([]float64, numLinPts + histLogPts)
 
 	var i uint64
+	// computed from integers in a single division, so the bounds are the closest floats to the decimal values
 	for i = 0; i < numLinPts; i++ {
-		ret[i] = float64(histMinLatency)/1000.0 + float64(i) / float64(histLinearPtsPerMs) / 1000.0
+		ret[i] = float64(histMinLatency*histLinearPtsPerMs+i) / float64(histLinearPtsPerMs*1000)
 	}
 
 	// calculate the log-spacing we need between
@@ -100,7 +81,8 @@ func MakePromHistBins(histMinLatency uint64, histMaxLatency uint64, histMaxLinea
 
 	var j uint64
 	for j = 0; uint64(j) < histLogPts; j++ {
-		ret[i+j] = math.Pow(float64(histMaxLinearLatency), 1.0+stepSize*float64(j)) / 1000.0
+		// rounded to nanoseconds
+		ret[i+j] = math.Round(math.Pow(float64(histMaxLinearLatency), 1.0+stepSize*float64(j))*1e6) / 1e9
 	}
 	return ret
 }
@@ -175,7 +157,7 @@ func (h *VictoHist) VisitNonZeroBuckets(f func(vmrange string, count uint64)) {
 	}
 }
 
-func WriteHistogramVictoriaMetrics(w *bufio.Writer, name string, tags string, timestamp uint64, histo []HistogramEntry, scale float64) error {
+func WriteHistogramVictoriaMetrics(me metricEmitter, name string, labels prometheus.Labels, timestamp time.Time, histo []HistogramEntry, scale float64) {
 	// rebin all the histogram bins into victoriametrics histogram
 	hist := VictoHist{}
 	for _, entry := range histo {
@@ -183,7 +165,8 @@ func WriteHistogramVictoriaMetrics(w *bufio.Writer, name string, tags string, ti
 		count := entry.value
 		bucketIdx := (math.Log10(v) - e10Min) * bucketsPerDecimal
 		hist.sum += v * float64(count)
-		if bucketIdx < 0 {
+		// negative values (e.g. unsynchronized clocks) can not be represented and end up in the lowest bucket
+		if v <= 0 || bucketIdx < 0 {
 			hist.lower += count
 		} else if bucketIdx >= bucketsCount {
 			hist.upper += count
@@ -206,23 +189,21 @@ func WriteHistogramVictoriaMetrics(w *bufio.Writer, name string, tags string, ti
 		}
 	}
 
-	// now output all non-zero buckets
+	// now output all non-zero buckets, there is no histogram type with vmrange buckets so they are untyped
 	countTotal := uint64(0)
 	hist.VisitNonZeroBuckets(func(vmrange string, count uint64) {
-		fmt.Fprintf(w, "%s_bucket{%s,vmrange=%q} %d %d\n", name, tags, vmrange, count, timestamp)
+		me.addAt(name+"_bucket", labels, float64(count), timestamp, "vmrange", vmrange)
 		countTotal += count
 	})
 
 	// just quit if we didn't output anything
 	if countTotal == 0 {
-		return nil
+		return
 	}
 
 	// output sum
-	fmt.Fprintf(w, "%s_sum{%s} %g %d\n", name, tags, hist.sum, timestamp)
+	me.addAt(name+"_sum", labels, hist.sum, timestamp)
 
 	// output count
-	fmt.Fprintf(w, "%s_count{%s} %d %d\n", name, tags, countTotal, timestamp)
-
-	return nil
+	me.addAt(name+"_count", labels, float64(countTotal), timestamp)
 }
@@ -3,51 +3,136 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 var configFile = flag.String("cfg-file", "owamp-export.cfg", "The configuration file")
 var listenPort = flag.Uint("listen-port", 9099, "Listen port for exporter")
 var powstreamCmd = flag.String("powstream-cmd", "powstream", "Location of powstream binary to use")
+var owpingCmd = flag.String("owping-cmd", "owping", "Location of owping binary to use")
 var workDir = flag.String("workdir", "", "Location to place collected owping reports")
+var stopTimeout = flag.Duration("stop-timeout", 10*time.Second, "Time to wait for powstream to exit before killing it")
 var victoriaHistogram = flag.Bool("victoria-histogram", false, "Use the VictoriaMetrics histogram format")
 
-func main() {
-	flag.Parse()
-
-	// read configuration file
+// read the configuration file and apply the command line overrides
+func loadConfig() (Config, error) {
 	data, err := os.ReadFile(*configFile)
 	if err != nil {
-		log.Fatal(err)
+		return Config{}, err
 	}
 	cr := bufio.NewReader(bytes.NewReader(data))
 	cfg, err := ParseConfig(cr)
 	if err != nil {
-		log.Fatal(err)
+		return cfg, err
 	}
 
 	// override some config things
 	cfg.powstreamCmd = *powstreamCmd
+	cfg.owpingCmd = *owpingCmd
+	cfg.stopTimeout = *stopTimeout
 	if *workDir != "" {
 		cfg.baseWorkDir = *workDir
 	}
+	return cfg, nil
+}
+
+func main() {
+	flag.Parse()
+
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	// launch registry
 	reg := NewRegistry(cfg)
 	reg.victoriaHistogram = *victoriaHistogram
 
-	// launch workers
-	for idx, _ := range cfg.measurements {
-		w := NewWorker(cfg, uint(idx), reg.inChannel)
-		go w.RunWorker()
+	// launch the built-in OWAMP server
+	if cfg.responder.enabled {
+		srv := NewOWAMPServer(cfg.responder)
+		reg.responder = srv
+		go func() {
+			log.Fatal(srv.ListenAndServe())
+		}()
+	}
+
+	// launch the built-in STAMP session-reflector
+	if cfg.reflector.enabled {
+		refl := NewSTAMPReflector(cfg.reflector)
+		reg.reflector = refl
+		go func() {
+			log.Fatal(refl.ListenAndServe())
+		}()
+	}
+
+	// restore the last reports from the previous run
+	if cfg.stateFile != "" {
+		if err := reg.LoadState(); err != nil {
+			log.Printf("failed to load state from %s: %v", cfg.stateFile, err)
+		}
 	}
 
-	http.HandleFunc("/metrics", func(w http.ResponseWriter, req *http.Request) {
-		reg.DumpMetrics(w)
+	// launch workers, they are stopped on SIGTERM or SIGINT
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	reg.StartMeasurements(ctx)
+
+	// persist the state periodically and once the workers stopped
+	if cfg.stateFile != "" {
+		go reg.RunStateSaver(ctx, cfg.stateInterval)
+		reg.AddShutdownHook(reg.SaveState)
+	}
+
+	// reload the configuration on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := reg.Reload(loadConfig); err != nil {
+				log.Printf("configuration reload failed: %v", err)
+			}
+		}
+	}()
+
+	promReg := prometheus.NewRegistry()
+	promReg.MustRegister(reg)
+	http.Handle("/metrics", metricsHandler(promReg))
+	http.HandleFunc("/-/reload", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, "only POST requests allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := reg.Reload(loadConfig); err != nil {
+			log.Printf("configuration reload failed: %v", err)
+			http.Error(w, fmt.Sprintf("failed to reload config: %v", err), http.StatusInternalServerError)
+			return
+		}
 	})
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *listenPort), nil))
+	server := &http.Server{Addr: fmt.Sprintf(":%d", *listenPort)}
+	go func() {
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	<-ctx.Done()
+	log.Printf("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), *stopTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("failed to stop HTTP server: %v", err)
+	}
+	// leave the workers time to kill powstream after the stop timeout
+	reg.Shutdown(*stopTimeout + 5*time.Second)
 }
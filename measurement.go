@@ -1 +1,103 @@
 package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// interface implemented by all measurement engines
+//
+// A backend runs the measurement described by cfg.measurements[idx] and sends
+// its results to the registry as MeasurementReport on the channel it was
+// created with. RunWorker returns when ctx is cancelled or the backend gives up.
+type MeasurementBackend interface {
+	RunWorker(ctx context.Context)
+}
+
+type MeasurementBackendFactory func(cfg Config, idx uint, outCh chan MeasurementReport) MeasurementBackend
+
+// backend-neutral result of a measurement session
+//
+// Depending on the backend a report carries the summary, the per-packet data
+// of the session or both. The registry derives all metrics from these.
+type MeasurementReport struct {
+	measurementIdx   uint
+	metricsTimestamp OWTimestamp
+
+	// summary of the session (nil if the backend only delivers per-packet data)
+	summary *SummaryReport
+
+	// per-packet data of the session (nil if the backend only delivers summaries)
+	session *OWPSession
+
+	// reverse direction and round-trip results of two-way measurements
+	twoWay *TwoWayReport
+
+	// reason the summary of the session could not be parsed (no other field is set then)
+	parseError string
+}
+
+// available measurement backends by the name used in the MEASUREMENT backend= option
+var measurementBackends = map[string]MeasurementBackendFactory{
+	"powstream": func(cfg Config, idx uint, outCh chan MeasurementReport) MeasurementBackend {
+		return NewWorker(cfg, idx, outCh)
+	},
+	"owping": func(cfg Config, idx uint, outCh chan MeasurementReport) MeasurementBackend {
+		return NewOwpingWorker(cfg, idx, outCh)
+	},
+	"native": func(cfg Config, idx uint, outCh chan MeasurementReport) MeasurementBackend {
+		// the two-way protocols are only implemented natively
+		if cfg.measurements[idx].protocol != "owamp" {
+			return NewTWAMPWorker(cfg, idx, outCh)
+		}
+		return NewNativeWorker(cfg, idx, outCh)
+	},
+	"external": func(cfg Config, idx uint, outCh chan MeasurementReport) MeasurementBackend {
+		return NewExternalWorker(cfg, idx, outCh)
+	},
+	"replay": func(cfg Config, idx uint, outCh chan MeasurementReport) MeasurementBackend {
+		return NewReplayWorker(cfg, idx, outCh)
+	},
+}
+
+func RegisterMeasurementBackend(name string, factory MeasurementBackendFactory) {
+	measurementBackends[name] = factory
+}
+
+// create the backend selected in the configuration of the measurement
+func NewMeasurementBackend(cfg Config, idx uint, outCh chan MeasurementReport) (MeasurementBackend, error) {
+	name := cfg.measurements[idx].backend
+	factory, ok := measurementBackends[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown measurement backend %s", name)
+	}
+	return factory(cfg, idx, outCh), nil
+}
+
+// sleep for the given duration, returns false if ctx was cancelled in the meantime
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+func parseErrorReport(idx uint, err error) MeasurementReport {
+	return MeasurementReport{
+		measurementIdx: idx,
+		parseError:     summaryErrorReason(err),
+	}
+}
+
+func summaryMeasurementReport(idx uint, summary SummaryReport) MeasurementReport {
+	return MeasurementReport{
+		measurementIdx:   idx,
+		summary:          &summary,
+		metricsTimestamp: summary.startTime.Mid(summary.endTime),
+	}
+}
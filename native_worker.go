@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+// measurement backend running the OWAMP sessions in-process using the native OWAMP client
+
+const (
+	nativeControlTimeout = 30 * time.Second
+	nativeStartDelay     = 2 * time.Second
+	nativeLossTimeout    = 10 * time.Second
+	nativeRetryDelay     = 30 * time.Second
+)
+
+type NativeWorker struct {
+	measurementOut chan MeasurementReport
+	measurementIdx uint
+	cfg            Config
+	mcfg           MeasurementCfg
+}
+
+func NewNativeWorker(cfg Config, idx uint, outCh chan MeasurementReport) *NativeWorker {
+	return &NativeWorker{
+		measurementOut: outCh,
+		measurementIdx: idx,
+		cfg:            cfg,
+		mcfg:           cfg.measurements[idx],
+	}
+}
+
+func (w *NativeWorker) RunWorker(ctx context.Context) {
+	bucketWidth, err := strconv.ParseFloat(w.mcfg.bucketWidth, 64)
+	if err != nil {
+		log.Printf("%d invalid bucket width %s: %v", w.measurementIdx, w.mcfg.bucketWidth, err)
+		return
+	}
+
+	for {
+		session, err := w.runSession(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("%d session failed: %v", w.measurementIdx, err)
+			// wait a bit before trying again
+			if !sleepContext(ctx, nativeRetryDelay) {
+				return
+			}
+			continue
+		}
+
+		report := summaryMeasurementReport(w.measurementIdx, SummarizeSession(&session, bucketWidth))
+		report.session = &session
+		w.measurementOut <- report
+	}
+}
+
+// fill in the port and SID returned in Accept-Session
+func acceptSession(req *OWPSession, sender bool, port uint16, sid [16]byte) {
+	if sender {
+		// the server is the receiver and picks the SID
+		req.sid = sid
+		req.receiverPort = port
+	} else {
+		// we picked the SID ourselves, whatever the server echoes is ignored
+		req.senderPort = port
+	}
+}
+
+// run a single test session and return the resulting per-packet data
+func (w *NativeWorker) runSession(ctx context.Context) (OWPSession, error) {
+	src := w.cfg.targets[w.mcfg.targetSrc]
+	dst := w.cfg.targets[w.mcfg.targetDst]
+
+	// one side of the measurement has to be the local host, the other runs the OWAMP server
+	var server string
+	var sender bool
+	if src.local {
+		server = dst.hostname
+		sender = true
+	} else if dst.local {
+		server = src.hostname
+		sender = false
+	} else {
+		return OWPSession{}, errors.New("native backend requires either source or destination to be local")
+	}
+
+	client, err := DialOWAMP(owampServerAddress(server), nativeControlTimeout)
+	if err != nil {
+		return OWPSession{}, err
+	}
+	defer client.Close()
+	// abort the session when the measurement is stopped
+	stop := context.AfterFunc(ctx, func() { client.Close() })
+	defer stop()
+
+	localIP := client.LocalAddr().(*net.TCPAddr).IP
+	remoteIP := client.RemoteAddr().(*net.TCPAddr).IP
+	network := "udp6"
+	if localIP.To4() != nil {
+		network = "udp4"
+	}
+	conn, err := listenUDPInRange(network, localIP, w.cfg.portRangeMin, w.cfg.portRangeMax)
+	if err != nil {
+		return OWPSession{}, err
+	}
+	defer conn.Close()
+	stopConn := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stopConn()
+	localPort := uint16(conn.LocalAddr().(*net.UDPAddr).Port)
+
+	interval := time.Second / time.Duration(w.mcfg.pps)
+	req := OWPSession{
+		ipVersion:    owampIPVersion(localIP),
+		confSender:   !sender,
+		confReceiver: sender,
+		numPackets:   uint32(w.mcfg.duration * w.mcfg.pps),
+		startTime:    OWTimestampFromTime(time.Now().Add(nativeStartDelay)),
+		lossTimeout:  uint64(nativeLossTimeout.Seconds()) << 32,
+		slots: []OWPSlot{
+			{slotType: owpSlotLiteral, interval: uint64(interval.Seconds() * (1 << 32))},
+		},
+	}
+	if sender {
+		req.senderAddr, req.senderPort = localIP, localPort
+		req.receiverAddr = remoteIP
+	} else {
+		req.senderAddr = remoteIP
+		req.receiverAddr, req.receiverPort = localIP, localPort
+		// as receiver we have to pick the SID
+		req.sid = newSID()
+	}
+
+	port, sid, err := client.RequestSession(&req)
+	if err != nil {
+		return req, err
+	}
+	acceptSession(&req, sender, port, sid)
+
+	if err = client.StartSessions(); err != nil {
+		return req, err
+	}
+
+	if sender {
+		if err = sendTestPackets(conn, &net.UDPAddr{IP: remoteIP, Port: int(port)}, &req, interval); err != nil {
+			return req, err
+		}
+		// give the receiver time to account for the last packets
+		if !sleepContext(ctx, nativeLossTimeout) {
+			return req, ctx.Err()
+		}
+		_, err = client.StopSessions([]owampSessionDesc{{sid: req.sid, nextSeqNo: req.numPackets}})
+		if err != nil {
+			return req, err
+		}
+		data, err := client.FetchSession(req.sid, 0, 0xffffffff, req.numPackets)
+		if err != nil {
+			return req, err
+		}
+		req.finished = data.finished
+		req.nextSeqNo = data.nextSeqNo
+		req.skipRanges = data.skipRanges
+		req.records = data.records
+	} else {
+		req.records = receiveTestPackets(conn, &req, interval, nativeLossTimeout)
+		sessions, err := client.StopSessions(nil)
+		if err != nil {
+			return req, err
+		}
+		for _, desc := range sessions {
+			if desc.sid == req.sid {
+				req.nextSeqNo = desc.nextSeqNo
+				req.skipRanges = desc.skipRanges
+			}
+		}
+		req.finished = 1
+	}
+
+	return req, nil
+}
+
+// send the test packets of the session according to its (fixed interval) schedule
+func sendTestPackets(conn *net.UDPConn, addr *net.UDPAddr, sess *OWPSession, interval time.Duration) error {
+	start := sess.startTime.Time()
+	buf := make([]byte, owampTestPacketSize+int(sess.paddingLength))
+	for seq := uint32(0); seq < sess.numPackets; seq++ {
+		time.Sleep(time.Until(start.Add(time.Duration(seq) * interval)))
+		encodeTestPacket(buf, seq, OWTimestampFromTime(time.Now()), owampDefaultErrEstimate)
+		if _, err := conn.WriteToUDP(buf, addr); err != nil {
+			return fmt.Errorf("failed sending test packet: %v", err)
+		}
+	}
+	return nil
+}
+
+// receive the test packets of the session and return the records including the lost packets
+func receiveTestPackets(conn *net.UDPConn, sess *OWPSession, interval time.Duration, lossTimeout time.Duration) []OWPRecord {
+	start := sess.startTime.Time()
+	end := start.Add(time.Duration(sess.numPackets) * interval).Add(lossTimeout)
+	conn.SetReadDeadline(end)
+
+	records := make([]OWPRecord, 0, sess.numPackets)
+	received := make(map[uint32]bool)
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			break
+		}
+		recvTime := OWTimestampFromTime(time.Now())
+		seq, sendTime, errEst, err := parseTestPacket(buf[:n])
+		if err != nil || seq >= sess.numPackets {
+			continue
+		}
+		records = append(records, OWPRecord{
+			seqNo:      seq,
+			sendTime:   sendTime,
+			sendErrEst: errEst,
+			recvTime:   recvTime,
+			recvErrEst: owampDefaultErrEstimate,
+			ttl:        owpTTLUnknown,
+		})
+		received[seq] = true
+	}
+
+	// add records for the lost packets with their scheduled send time
+	for seq := uint32(0); seq < sess.numPackets; seq++ {
+		if !received[seq] {
+			records = append(records, OWPRecord{
+				seqNo:    seq,
+				sendTime: OWTimestampFromTime(start.Add(time.Duration(seq) * interval)),
+				ttl:      owpTTLUnknown,
+			})
+		}
+	}
+	return records
+}
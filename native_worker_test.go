@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestAcceptSession(t *testing.T) {
+	local := [16]byte{1}
+	remote := [16]byte{2}
+	tests := []struct {
+		name         string
+		sender       bool
+		wantSID      [16]byte
+		wantSender   uint16
+		wantReceiver uint16
+	}{
+		{"sender", true, remote, 1000, 2000},
+		// the SID chosen as receiver is kept even if the server returns another one
+		{"receiver", false, local, 2000, 1000},
+	}
+
+	for _, tt := range tests {
+		req := OWPSession{sid: local}
+		if tt.sender {
+			req.senderPort = 1000
+		} else {
+			req.receiverPort = 1000
+		}
+		acceptSession(&req, tt.sender, 2000, remote)
+		if req.sid != tt.wantSID || req.senderPort != tt.wantSender || req.receiverPort != tt.wantReceiver {
+			t.Errorf("%s: got SID %x and ports %d/%d, want %x and %d/%d", tt.name,
+				req.sid, req.senderPort, req.receiverPort, tt.wantSID, tt.wantSender, tt.wantReceiver)
+		}
+	}
+}
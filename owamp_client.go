@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+)
+
+// native OWAMP control-client (RFC 4656) in unauthenticated mode
+
+type OWAMPClient struct {
+	c owampConn
+}
+
+// connect to the OWAMP server, negotiate the mode and wait for the Server-Start message
+func DialOWAMP(address string, timeout time.Duration) (*OWAMPClient, error) {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	client := &OWAMPClient{c: owampConn{conn: conn, timeout: timeout}}
+
+	if err = client.setup(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+func (client *OWAMPClient) setup() error {
+	greeting, err := client.c.read(owampGreetingSize)
+	if err != nil {
+		return err
+	}
+	modes := binary.BigEndian.Uint32(greeting[12:16])
+	if modes == 0 {
+		return errors.New("server refused the connection")
+	}
+	if modes&owampModeOpen == 0 {
+		return errors.New("server does not support the unauthenticated mode")
+	}
+
+	// Set-Up-Response with KeyID, Token and Client-IV left empty
+	resp := make([]byte, owampSetupResponseSize)
+	binary.BigEndian.PutUint32(resp[0:4], owampModeOpen)
+	if err = client.c.write(resp); err != nil {
+		return err
+	}
+
+	start, err := client.c.read(owampServerStartSize)
+	if err != nil {
+		return err
+	}
+	if start[15] != owampAcceptOK {
+		return owampAcceptError("connection", start[15])
+	}
+	return nil
+}
+
+func (client *OWAMPClient) Close() error {
+	return client.c.Close()
+}
+
+func (client *OWAMPClient) LocalAddr() net.Addr {
+	return client.c.conn.LocalAddr()
+}
+
+func (client *OWAMPClient) RemoteAddr() net.Addr {
+	return client.c.conn.RemoteAddr()
+}
+
+// request a test session, returns the port on the server side and the SID of the session
+func (client *OWAMPClient) RequestSession(req *OWPSession) (uint16, [16]byte, error) {
+	var sid [16]byte
+	if err := client.c.write(encodeOWPTestRequest(req)); err != nil {
+		return 0, sid, err
+	}
+	resp, err := client.c.read(owampAcceptSessionSize)
+	if err != nil {
+		return 0, sid, err
+	}
+	if resp[0] != owampAcceptOK {
+		return 0, sid, owampAcceptError("session request", resp[0])
+	}
+	copy(sid[:], resp[4:20])
+	return binary.BigEndian.Uint16(resp[2:4]), sid, nil
+}
+
+func (client *OWAMPClient) StartSessions() error {
+	msg := make([]byte, owampStartSessionsSize)
+	msg[0] = owampCmdStartSessions
+	if err := client.c.write(msg); err != nil {
+		return err
+	}
+	resp, err := client.c.read(owampStartAckSize)
+	if err != nil {
+		return err
+	}
+	if resp[0] != owampAcceptOK {
+		return owampAcceptError("start sessions", resp[0])
+	}
+	return nil
+}
+
+// send Stop-Sessions with the descriptions of the sessions we are the sender of
+// and return the session descriptions of the server
+func (client *OWAMPClient) StopSessions(sessions []owampSessionDesc) ([]owampSessionDesc, error) {
+	if err := client.c.write(encodeStopSessions(owampAcceptOK, sessions)); err != nil {
+		return nil, err
+	}
+	hdr, err := client.c.read(owampStopSessionsSize)
+	if err != nil {
+		return nil, err
+	}
+	if hdr[0] != owampCmdStopSessions {
+		return nil, errors.New("unexpected response to stop sessions")
+	}
+	accept, ret, err := readStopSessions(&client.c, hdr)
+	if err != nil {
+		return ret, err
+	}
+	if accept != owampAcceptOK {
+		return ret, owampAcceptError("stop sessions", accept)
+	}
+	return ret, nil
+}
+
+// fetch the records of the given session stored on the server, numPackets is the number of packets
+// of the session (0 if unknown) and limits the records accepted together with the requested range
+func (client *OWAMPClient) FetchSession(sid [16]byte, begin uint32, end uint32, numPackets uint32) (OWPSession, error) {
+	ret := OWPSession{sid: sid}
+
+	msg := make([]byte, owampFetchSessionSize)
+	msg[0] = owampCmdFetchSession
+	binary.BigEndian.PutUint32(msg[8:12], begin)
+	binary.BigEndian.PutUint32(msg[12:16], end)
+	copy(msg[16:32], sid[:])
+	if err := client.c.write(msg); err != nil {
+		return ret, err
+	}
+
+	ack, err := client.c.read(owampFetchAckSize)
+	if err != nil {
+		return ret, err
+	}
+	if ack[0] != owampAcceptOK {
+		return ret, owampAcceptError("fetch session", ack[0])
+	}
+	ret.finished = uint32(ack[1])
+	ret.nextSeqNo = binary.BigEndian.Uint32(ack[4:8])
+	numSkipRanges := binary.BigEndian.Uint32(ack[8:12])
+	numRecords := binary.BigEndian.Uint32(ack[12:16])
+	if numSkipRanges > owampMaxSkipRanges {
+		return ret, errors.New("too many skip ranges")
+	}
+	// duplicates are stored as separate records, allow one per packet
+	maxRecords := uint64(end) - uint64(begin) + 1
+	if numPackets > 0 && 2*uint64(numPackets) < maxRecords {
+		maxRecords = 2 * uint64(numPackets)
+	}
+	if uint64(numRecords) > maxRecords || numRecords > owampMaxFetchRecords {
+		return ret, errors.New("too many data records")
+	}
+
+	// skip ranges followed by HMAC
+	b, err := client.c.read(owampPadded(int(numSkipRanges)*owpSkipRangeSize) + owampHMACSize)
+	if err != nil {
+		return ret, err
+	}
+	ret.skipRanges = parseSkipRanges(b, int(numSkipRanges))
+
+	// data records followed by HMAC
+	b, err = client.c.read(owampPadded(int(numRecords)*owpDataRecordSize) + owampHMACSize)
+	if err != nil {
+		return ret, err
+	}
+	ret.records = make([]OWPRecord, numRecords)
+	for i := range ret.records {
+		ret.records[i] = parseOWPRecord(b[i*owpDataRecordSize:])
+	}
+	return ret, nil
+}
+
+func owampServerAddress(hostname string) string {
+	if _, _, err := net.SplitHostPort(hostname); err == nil {
+		return hostname
+	}
+	return net.JoinHostPort(hostname, strconv.Itoa(owampControlPort))
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+const (
+	testPackets  = 5
+	testInterval = 10 * time.Millisecond
+)
+
+// run a built-in OWAMP server on an ephemeral port of the loopback interface
+func startTestOWAMPServer(t *testing.T, cfg ResponderCfg) (*OWAMPServer, string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	srv := NewOWAMPServer(cfg)
+	go srv.Serve(l)
+	return srv, l.Addr().String()
+}
+
+func dialTestOWAMPServer(t *testing.T, address string) *OWAMPClient {
+	t.Helper()
+	client, err := DialOWAMP(address, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// session request from the point of view of the control-client
+func testSessionRequest(sender bool, conn *net.UDPConn) OWPSession {
+	localIP := net.ParseIP("127.0.0.1")
+	req := OWPSession{
+		ipVersion:    4,
+		confSender:   !sender,
+		confReceiver: sender,
+		numPackets:   testPackets,
+		startTime:    OWTimestampFromTime(time.Now().Add(50 * time.Millisecond)),
+		lossTimeout:  1 << 32,
+		slots: []OWPSlot{
+			{slotType: owpSlotLiteral, interval: uint64(testInterval.Seconds() * (1 << 32))},
+		},
+	}
+	localPort := uint16(conn.LocalAddr().(*net.UDPAddr).Port)
+	if sender {
+		req.senderAddr, req.senderPort = localIP, localPort
+		req.receiverAddr = localIP
+	} else {
+		req.senderAddr = localIP
+		req.receiverAddr, req.receiverPort = localIP, localPort
+		req.sid = newSID()
+	}
+	return req
+}
+
+func listenTestUDP(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func checkTestRecords(t *testing.T, records []OWPRecord) {
+	t.Helper()
+	if len(records) != testPackets {
+		t.Fatalf("got %d records, want %d", len(records), testPackets)
+	}
+	seen := make(map[uint32]bool)
+	for _, rec := range sortedRecords(records) {
+		if rec.lost() {
+			t.Errorf("packet %d lost on loopback", rec.seqNo)
+		}
+		if d := rec.delay(); d < 0 || d > 1 {
+			t.Errorf("packet %d has implausible delay %v", rec.seqNo, d)
+		}
+		seen[rec.seqNo] = true
+	}
+	if len(seen) != testPackets {
+		t.Errorf("got sequence numbers %v, want 0-%d", seen, testPackets-1)
+	}
+}
+
+func TestOWAMPRoundTripSender(t *testing.T) {
+	_, address := startTestOWAMPServer(t, ResponderCfg{maxSessions: 1, maxPackets: 100})
+	client := dialTestOWAMPServer(t, address)
+	conn := listenTestUDP(t)
+
+	req := testSessionRequest(true, conn)
+	port, sid, err := client.RequestSession(&req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.sid, req.receiverPort = sid, port
+	if err = client.StartSessions(); err != nil {
+		t.Fatal(err)
+	}
+	if err = sendTestPackets(conn, &net.UDPAddr{IP: req.receiverAddr, Port: int(port)}, &req, testInterval); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if _, err = client.StopSessions([]owampSessionDesc{{sid: sid, nextSeqNo: testPackets}}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := client.FetchSession(sid, 0, 0xffffffff, testPackets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.finished != 1 || data.nextSeqNo != testPackets {
+		t.Errorf("finished = %d, nextSeqNo = %d, want 1, %d", data.finished, data.nextSeqNo, testPackets)
+	}
+	checkTestRecords(t, data.records)
+
+	// a range selects the records of the packets within it
+	data, err = client.FetchSession(sid, 1, 2, testPackets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data.records) != 2 {
+		t.Errorf("got %d records for range 1-2, want 2", len(data.records))
+	}
+}
+
+func TestOWAMPRoundTripReceiver(t *testing.T) {
+	_, address := startTestOWAMPServer(t, ResponderCfg{})
+	client := dialTestOWAMPServer(t, address)
+	conn := listenTestUDP(t)
+
+	req := testSessionRequest(false, conn)
+	port, sid, err := client.RequestSession(&req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sid != req.sid {
+		t.Errorf("server changed the SID chosen by the receiver")
+	}
+	req.senderPort = port
+	if err = client.StartSessions(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the server schedules the packets one interval after the start time
+	records := receiveTestPackets(conn, &req, testInterval, 200*time.Millisecond)
+	checkTestRecords(t, records)
+
+	sessions, err := client.StopSessions(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || sessions[0].sid != sid || sessions[0].nextSeqNo != testPackets {
+		t.Errorf("stop sessions returned %+v, want SID %X with next seqno %d", sessions, sid, testPackets)
+	}
+}
+
+func TestOWAMPFetchUnknownSession(t *testing.T) {
+	_, address := startTestOWAMPServer(t, ResponderCfg{})
+	client := dialTestOWAMPServer(t, address)
+
+	if _, err := client.FetchSession(newSID(), 0, 0xffffffff, 0); err == nil {
+		t.Error("fetching an unknown session succeeded")
+	}
+}
+
+// the size announced in the Fetch-Ack of a misbehaving server must not be trusted
+func TestOWAMPFetchSessionLimits(t *testing.T) {
+	tests := []struct {
+		name          string
+		begin, end    uint32
+		numPackets    uint32
+		numSkipRanges uint32
+		numRecords    uint32
+	}{
+		{"skip ranges", 0, 0xffffffff, 10, owampMaxSkipRanges + 1, 0},
+		{"records beyond range", 0, 9, 0, 0, 11},
+		{"records beyond duplicates", 0, 0xffffffff, 10, 0, 21},
+		{"records beyond limit", 0, 0xffffffff, 0, 0, owampMaxFetchRecords + 1},
+	}
+
+	for _, tt := range tests {
+		local, remote := net.Pipe()
+		client := &OWAMPClient{c: owampConn{conn: local, timeout: 5 * time.Second}}
+		go func() {
+			defer remote.Close()
+			c := owampConn{conn: remote, timeout: 5 * time.Second}
+			if _, err := c.read(owampFetchSessionSize); err != nil {
+				return
+			}
+			ack := make([]byte, owampFetchAckSize)
+			binary.BigEndian.PutUint32(ack[8:12], tt.numSkipRanges)
+			binary.BigEndian.PutUint32(ack[12:16], tt.numRecords)
+			c.write(ack)
+		}()
+
+		_, err := client.FetchSession(newSID(), tt.begin, tt.end, tt.numPackets)
+		if err == nil {
+			t.Errorf("%s: fetch accepted %d skip ranges and %d records", tt.name, tt.numSkipRanges, tt.numRecords)
+		}
+		client.Close()
+	}
+}
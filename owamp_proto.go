@@ -0,0 +1,284 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// message encoding of the OWAMP control and test protocol (RFC 4656)
+//
+// Only the unauthenticated mode is implemented, all HMAC fields are
+// zero-filled on output and ignored on input.
+
+const (
+	owampControlPort = 861
+
+	owampModeOpen = 1
+
+	owampCmdRequestSession = 1
+	owampCmdStartSessions  = 2
+	owampCmdStopSessions   = 3
+	owampCmdFetchSession   = 4
+
+	owampAcceptOK          = 0
+	owampAcceptFailure     = 1
+	owampAcceptInternal    = 2
+	owampAcceptUnsupported = 3
+	owampAcceptPermLimit   = 4
+	owampAcceptTempLimit   = 5
+	// RFC 4656 has no dedicated value for requests refused by policy
+	owampAcceptProhibited = owampAcceptFailure
+
+	owampGreetingSize      = 64
+	owampSetupResponseSize = 164
+	owampServerStartSize   = 48
+	owampAcceptSessionSize = 48
+	owampStartSessionsSize = 32
+	owampStartAckSize      = 32
+	owampStopSessionsSize  = 16
+	owampFetchSessionSize  = 48
+	owampFetchAckSize      = 32
+	owampHMACSize          = 16
+	owampSessionDescSize   = 24
+
+	// upper limit of skip ranges accepted per session description
+	owampMaxSkipRanges = 65536
+	// upper limit of data records accepted in a fetch reply (keeps the size within an int on 32-bit)
+	owampMaxFetchRecords = 1 << 24
+
+	// sequence number, timestamp and error estimate of an unauthenticated test packet
+	owampTestPacketSize = 14
+
+	// error estimate for a clock which is not synchronized with an error of about 1ms
+	owampDefaultErrEstimate = 0x1601
+)
+
+var owampAcceptNames = map[uint8]string{
+	owampAcceptOK:          "OK",
+	owampAcceptFailure:     "failure",
+	owampAcceptInternal:    "internal error",
+	owampAcceptUnsupported: "not supported",
+	owampAcceptPermLimit:   "permanent resource limitation",
+	owampAcceptTempLimit:   "temporary resource limitation",
+}
+
+func owampAcceptError(msg string, accept uint8) error {
+	name, ok := owampAcceptNames[accept]
+	if !ok {
+		name = fmt.Sprintf("unknown accept value %d", accept)
+	}
+	return fmt.Errorf("%s rejected: %s", msg, name)
+}
+
+// session description as sent in the Stop-Sessions message
+type owampSessionDesc struct {
+	sid        [16]byte
+	nextSeqNo  uint32
+	skipRanges []OWPSkipRange
+}
+
+// control connection with deadline handling
+type owampConn struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (c *owampConn) read(n int) ([]byte, error) {
+	buf := make([]byte, n)
+	if c.timeout > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+	}
+	_, err := io.ReadFull(c.conn, buf)
+	return buf, err
+}
+
+func (c *owampConn) write(b []byte) error {
+	if c.timeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	}
+	_, err := c.conn.Write(b)
+	return err
+}
+
+func (c *owampConn) Close() error {
+	return c.conn.Close()
+}
+
+// round up to the 16 octet blocks used by the control protocol
+func owampPadded(n int) int {
+	return (n + 15) / 16 * 16
+}
+
+func newSID() [16]byte {
+	var sid [16]byte
+	_, _ = rand.Read(sid[:])
+	return sid
+}
+
+func owampIPVersion(ip net.IP) uint8 {
+	if ip.To4() != nil {
+		return 4
+	}
+	return 6
+}
+
+func encodeOWPAddress(b []byte, ip net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		copy(b[0:4], ip4)
+	} else {
+		copy(b[0:16], ip.To16())
+	}
+}
+
+// encode the Request-Session message including the schedule slots and the trailing HMAC
+func encodeOWPTestRequest(sess *OWPSession) []byte {
+	b := make([]byte, owpTestRequestSize+len(sess.slots)*owpSlotSize+owampHMACSize)
+	b[0] = owampCmdRequestSession
+	b[1] = sess.ipVersion & 0x0f
+	if sess.confSender {
+		b[2] = 1
+	}
+	if sess.confReceiver {
+		b[3] = 1
+	}
+	binary.BigEndian.PutUint32(b[4:8], uint32(len(sess.slots)))
+	binary.BigEndian.PutUint32(b[8:12], sess.numPackets)
+	binary.BigEndian.PutUint16(b[12:14], sess.senderPort)
+	binary.BigEndian.PutUint16(b[14:16], sess.receiverPort)
+	encodeOWPAddress(b[16:32], sess.senderAddr)
+	encodeOWPAddress(b[32:48], sess.receiverAddr)
+	copy(b[48:64], sess.sid[:])
+	binary.BigEndian.PutUint32(b[64:68], sess.paddingLength)
+	binary.BigEndian.PutUint64(b[68:76], uint64(sess.startTime))
+	binary.BigEndian.PutUint64(b[76:84], sess.lossTimeout)
+	binary.BigEndian.PutUint32(b[84:88], sess.typeP)
+
+	for i, slot := range sess.slots {
+		sb := b[owpTestRequestSize+i*owpSlotSize:]
+		sb[0] = slot.slotType
+		binary.BigEndian.PutUint64(sb[8:16], slot.interval)
+	}
+	return b
+}
+
+func encodeOWPRecord(b []byte, rec *OWPRecord) {
+	binary.BigEndian.PutUint32(b[0:4], rec.seqNo)
+	binary.BigEndian.PutUint64(b[4:12], uint64(rec.sendTime))
+	binary.BigEndian.PutUint16(b[12:14], rec.sendErrEst)
+	binary.BigEndian.PutUint64(b[14:22], uint64(rec.recvTime))
+	binary.BigEndian.PutUint16(b[22:24], rec.recvErrEst)
+	b[24] = rec.ttl
+}
+
+func encodeSkipRanges(skipRanges []OWPSkipRange) []byte {
+	b := make([]byte, owampPadded(len(skipRanges)*owpSkipRangeSize))
+	for i, sr := range skipRanges {
+		binary.BigEndian.PutUint32(b[i*owpSkipRangeSize:], sr.begin)
+		binary.BigEndian.PutUint32(b[i*owpSkipRangeSize+4:], sr.end)
+	}
+	return b
+}
+
+func parseSkipRanges(b []byte, n int) []OWPSkipRange {
+	ret := make([]OWPSkipRange, n)
+	for i := range ret {
+		ret[i].begin = binary.BigEndian.Uint32(b[i*owpSkipRangeSize:])
+		ret[i].end = binary.BigEndian.Uint32(b[i*owpSkipRangeSize+4:])
+	}
+	return ret
+}
+
+// encode a complete Stop-Sessions message
+func encodeStopSessions(accept uint8, sessions []owampSessionDesc) []byte {
+	descLen := 0
+	for _, sess := range sessions {
+		descLen += owampSessionDescSize + len(sess.skipRanges)*owpSkipRangeSize
+	}
+	b := make([]byte, owampStopSessionsSize+owampPadded(descLen)+owampHMACSize)
+	b[0] = owampCmdStopSessions
+	b[1] = accept
+	binary.BigEndian.PutUint32(b[4:8], uint32(len(sessions)))
+
+	off := owampStopSessionsSize
+	for _, sess := range sessions {
+		copy(b[off:off+16], sess.sid[:])
+		binary.BigEndian.PutUint32(b[off+16:off+20], sess.nextSeqNo)
+		binary.BigEndian.PutUint32(b[off+20:off+24], uint32(len(sess.skipRanges)))
+		off += owampSessionDescSize
+		for _, sr := range sess.skipRanges {
+			binary.BigEndian.PutUint32(b[off:off+4], sr.begin)
+			binary.BigEndian.PutUint32(b[off+4:off+8], sr.end)
+			off += owpSkipRangeSize
+		}
+	}
+	return b
+}
+
+// read the remainder of a Stop-Sessions message after its first block has been read
+func readStopSessions(c *owampConn, hdr []byte) (uint8, []owampSessionDesc, error) {
+	accept := hdr[1]
+	numSessions := binary.BigEndian.Uint32(hdr[4:8])
+
+	// the session descriptions are variable length, so read them piece by piece
+	sessions := make([]owampSessionDesc, 0)
+	read := 0
+	for i := uint32(0); i < numSessions; i++ {
+		b, err := c.read(owampSessionDescSize)
+		if err != nil {
+			return accept, sessions, err
+		}
+		sess := owampSessionDesc{}
+		copy(sess.sid[:], b[0:16])
+		sess.nextSeqNo = binary.BigEndian.Uint32(b[16:20])
+		numSkipRanges := int(binary.BigEndian.Uint32(b[20:24]))
+		if numSkipRanges > owampMaxSkipRanges {
+			return accept, sessions, errors.New("too many skip ranges")
+		}
+		if numSkipRanges > 0 {
+			sb, err := c.read(numSkipRanges * owpSkipRangeSize)
+			if err != nil {
+				return accept, sessions, err
+			}
+			sess.skipRanges = parseSkipRanges(sb, numSkipRanges)
+		}
+		read += owampSessionDescSize + numSkipRanges*owpSkipRangeSize
+		sessions = append(sessions, sess)
+	}
+
+	// padding and HMAC
+	if _, err := c.read(owampPadded(read) - read + owampHMACSize); err != nil {
+		return accept, sessions, err
+	}
+	return accept, sessions, nil
+}
+
+func encodeTestPacket(b []byte, seqNo uint32, ts OWTimestamp, errEst uint16) {
+	binary.BigEndian.PutUint32(b[0:4], seqNo)
+	binary.BigEndian.PutUint64(b[4:12], uint64(ts))
+	binary.BigEndian.PutUint16(b[12:14], errEst)
+}
+
+func parseTestPacket(b []byte) (uint32, OWTimestamp, uint16, error) {
+	if len(b) < owampTestPacketSize {
+		return 0, 0, 0, errors.New("test packet too short")
+	}
+	return binary.BigEndian.Uint32(b[0:4]), OWTimestamp(binary.BigEndian.Uint64(b[4:12])), binary.BigEndian.Uint16(b[12:14]), nil
+}
+
+// open a UDP socket on the first free port of the given port range
+func listenUDPInRange(network string, ip net.IP, portMin uint64, portMax uint64) (*net.UDPConn, error) {
+	var err error
+	for port := portMin; port <= portMax; port++ {
+		var conn *net.UDPConn
+		conn, err = net.ListenUDP(network, &net.UDPAddr{IP: ip, Port: int(port)})
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, fmt.Errorf("no free port in range %d-%d: %v", portMin, portMax, err)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEncodeOWPTestRequest(t *testing.T) {
+	for _, ip := range []string{"192.0.2.1", "2001:db8::1"} {
+		sess := testOWPSession(net.ParseIP(ip))
+		b := encodeOWPTestRequest(&sess)
+		if len(b) != owpTestRequestSize+len(sess.slots)*owpSlotSize+owampHMACSize {
+			t.Fatalf("%s: request has %d bytes", ip, len(b))
+		}
+
+		got := OWPSession{}
+		numSlots, err := parseOWPTestRequest(&got, b)
+		if err != nil {
+			t.Fatalf("%s: %v", ip, err)
+		}
+		got.slots = sess.slots
+		want := sess
+		// the file header fields are not part of the request
+		want.version, want.finished, want.nextSeqNo = 0, 0, 0
+		want.records, want.skipRanges = nil, nil
+		if numSlots != uint32(len(sess.slots)) || !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: decoded %d slots and %+v, want %+v", ip, numSlots, got, want)
+		}
+		sb := b[owpTestRequestSize:]
+		if sb[0] != sess.slots[0].slotType || binary.BigEndian.Uint64(sb[8:16]) != sess.slots[0].interval {
+			t.Errorf("%s: slot encoded as %v", ip, sb[:owpSlotSize])
+		}
+	}
+}
+
+func TestStopSessionsEncoding(t *testing.T) {
+	sessions := []owampSessionDesc{
+		{sid: newSID(), nextSeqNo: 10},
+		{sid: newSID(), nextSeqNo: 20, skipRanges: []OWPSkipRange{{3, 4}, {7, 7}}},
+	}
+	b := encodeStopSessions(owampAcceptOK, sessions)
+	if len(b)%16 != 0 {
+		t.Errorf("message of %d bytes is not padded to blocks", len(b))
+	}
+
+	local, remote := net.Pipe()
+	defer local.Close()
+	go func() {
+		remote.Write(b)
+		remote.Close()
+	}()
+	c := &owampConn{conn: local, timeout: 5 * time.Second}
+	hdr, err := c.read(owampStopSessionsSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accept, got, err := readStopSessions(c, hdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accept != owampAcceptOK || !reflect.DeepEqual(got, sessions) {
+		t.Errorf("read accept %d and %+v, want %+v", accept, got, sessions)
+	}
+}
+
+func TestTestPacketEncoding(t *testing.T) {
+	b := make([]byte, owampTestPacketSize)
+	encodeTestPacket(b, 42, 0x1122334455667788, owampDefaultErrEstimate)
+	seq, ts, errEst, err := parseTestPacket(b)
+	if err != nil || seq != 42 || ts != 0x1122334455667788 || errEst != owampDefaultErrEstimate {
+		t.Errorf("decoded %d, %X, %X, %v", seq, uint64(ts), errEst, err)
+	}
+	if _, _, _, err = parseTestPacket(b[:owampTestPacketSize-1]); err == nil {
+		t.Error("short test packet accepted")
+	}
+}
+
+// the receiver records the packets which are not sent as lost at their scheduled time
+func TestSendReceiveTestPackets(t *testing.T) {
+	localIP := net.ParseIP("127.0.0.1")
+	sender, err := net.ListenUDP("udp4", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	receiver, err := net.ListenUDP("udp4", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+
+	interval := 10 * time.Millisecond
+	sess := OWPSession{numPackets: 5, startTime: OWTimestampFromTime(time.Now().Add(20 * time.Millisecond))}
+	sent := sess
+	sent.numPackets = 3
+	go sendTestPackets(sender, receiver.LocalAddr().(*net.UDPAddr), &sent, interval)
+
+	records := receiveTestPackets(receiver, &sess, interval, 100*time.Millisecond)
+	if len(records) != 5 {
+		t.Fatalf("got %d records, want 5", len(records))
+	}
+	for _, rec := range records {
+		if lost := rec.seqNo >= 3; rec.lost() != lost {
+			t.Errorf("packet %d lost: %v, want %v", rec.seqNo, rec.lost(), lost)
+		}
+		scheduled := sess.startTime.Time().Add(time.Duration(rec.seqNo) * interval)
+		if d := rec.sendTime.Time().Sub(scheduled); d < -time.Millisecond || d > 50*time.Millisecond {
+			t.Errorf("packet %d sent %v after its scheduled time", rec.seqNo, d)
+		}
+	}
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// built-in OWAMP server (RFC 4656) in unauthenticated mode
+//
+// The server acts as receiver or sender of test sessions requested by remote
+// control-clients and keeps the data of the sessions of a control connection
+// around until the connection is closed, so it can be retrieved with Fetch-Session.
+
+const (
+	responderControlTimeout = 120 * time.Second
+)
+
+type ResponderCfg struct {
+	enabled        bool
+	listenAddr     string
+	portRangeMin   uint64
+	portRangeMax   uint64
+	maxConnections uint64
+	maxSessions    uint64
+	maxPackets     uint64
+}
+
+type ResponderStats struct {
+	connectionsTotal   uint64
+	connectionsActive  int64
+	sessionsTotal      uint64
+	sessionsActive     int64
+	sessionsRejected   uint64
+	packetsReceived    uint64
+	packetsSent        uint64
+	packetsMalformed   uint64
+	controlErrorsTotal uint64
+}
+
+type OWAMPServer struct {
+	cfg   ResponderCfg
+	stats ResponderStats
+
+	// all the sessions currently in use across all control connections
+	mutex    sync.Mutex
+	sessions uint64
+}
+
+type serverSession struct {
+	req     OWPSession
+	conn    *net.UDPConn
+	stop    chan struct{}
+	done    chan struct{}
+	started bool
+
+	// filled by the sender/receiver goroutine
+	sent    uint32
+	records []OWPRecord
+}
+
+func NewOWAMPServer(cfg ResponderCfg) *OWAMPServer {
+	return &OWAMPServer{cfg: cfg}
+}
+
+func (srv *OWAMPServer) ListenAndServe() error {
+	l, err := net.Listen("tcp", srv.cfg.listenAddr)
+	if err != nil {
+		return err
+	}
+	return srv.Serve(l)
+}
+
+func (srv *OWAMPServer) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go srv.handleConnection(conn)
+	}
+}
+
+func (srv *OWAMPServer) reserveSessions(n uint64) bool {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	if srv.cfg.maxSessions > 0 && srv.sessions+n > srv.cfg.maxSessions {
+		return false
+	}
+	srv.sessions += n
+	return true
+}
+
+func (srv *OWAMPServer) releaseSessions(n uint64) {
+	srv.mutex.Lock()
+	srv.sessions -= n
+	srv.mutex.Unlock()
+}
+
+func (srv *OWAMPServer) handleConnection(conn net.Conn) {
+	c := &owampConn{conn: conn, timeout: responderControlTimeout}
+	defer c.Close()
+
+	atomic.AddUint64(&srv.stats.connectionsTotal, 1)
+	active := atomic.AddInt64(&srv.stats.connectionsActive, 1)
+	defer atomic.AddInt64(&srv.stats.connectionsActive, -1)
+
+	// Server Greeting; refuse the connection by offering no modes when above the limit
+	greeting := make([]byte, owampGreetingSize)
+	if srv.cfg.maxConnections == 0 || uint64(active) <= srv.cfg.maxConnections {
+		binary.BigEndian.PutUint32(greeting[12:16], owampModeOpen)
+	}
+	challenge := newSID()
+	copy(greeting[16:32], challenge[:])
+	binary.BigEndian.PutUint32(greeting[48:52], 1024)
+	if err := c.write(greeting); err != nil {
+		return
+	}
+	if binary.BigEndian.Uint32(greeting[12:16]) == 0 {
+		return
+	}
+
+	resp, err := c.read(owampSetupResponseSize)
+	if err != nil {
+		return
+	}
+	start := make([]byte, owampServerStartSize)
+	binary.BigEndian.PutUint64(start[32:40], uint64(OWTimestampFromTime(time.Now())))
+	if binary.BigEndian.Uint32(resp[0:4]) != owampModeOpen {
+		start[15] = owampAcceptUnsupported
+		_ = c.write(start)
+		return
+	}
+	if err = c.write(start); err != nil {
+		return
+	}
+
+	sessions := make(map[[16]byte]*serverSession)
+	defer func() {
+		for _, sess := range sessions {
+			srv.finishSession(sess)
+		}
+		srv.releaseSessions(uint64(len(sessions)))
+	}()
+
+	for {
+		hdr, err := c.read(16)
+		if err != nil {
+			return
+		}
+		switch hdr[0] {
+		case owampCmdRequestSession:
+			err = srv.handleRequestSession(c, hdr, sessions)
+		case owampCmdStartSessions:
+			err = srv.handleStartSessions(c, sessions)
+		case owampCmdStopSessions:
+			err = srv.handleStopSessions(c, hdr, sessions)
+		case owampCmdFetchSession:
+			err = srv.handleFetchSession(c, hdr, sessions)
+		default:
+			err = errors.New("unknown command")
+		}
+		if err != nil {
+			atomic.AddUint64(&srv.stats.controlErrorsTotal, 1)
+			log.Printf("responder: control connection from %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+func (srv *OWAMPServer) rejectSession(c *owampConn, accept uint8) error {
+	atomic.AddUint64(&srv.stats.sessionsRejected, 1)
+	resp := make([]byte, owampAcceptSessionSize)
+	resp[0] = accept
+	return c.write(resp)
+}
+
+func (srv *OWAMPServer) handleRequestSession(c *owampConn, hdr []byte, sessions map[[16]byte]*serverSession) error {
+	rest, err := c.read(owpTestRequestSize - 16)
+	if err != nil {
+		return err
+	}
+	b := append(hdr, rest...)
+	req := OWPSession{}
+	numSlots, err := parseOWPTestRequest(&req, b)
+	if err != nil {
+		return err
+	}
+	if numSlots == 0 || numSlots > 1024 {
+		return errors.New("invalid number of schedule slots")
+	}
+	sb, err := c.read(int(numSlots)*owpSlotSize + owampHMACSize)
+	if err != nil {
+		return err
+	}
+	req.slots = make([]OWPSlot, numSlots)
+	for i := range req.slots {
+		req.slots[i].slotType = sb[i*owpSlotSize]
+		req.slots[i].interval = binary.BigEndian.Uint64(sb[i*owpSlotSize+8:])
+	}
+
+	// exactly one side of the session has to be configured by us
+	if req.confSender == req.confReceiver {
+		return srv.rejectSession(c, owampAcceptUnsupported)
+	}
+	// the test packets may only be exchanged with the peer of the control connection,
+	// otherwise any client could direct the sender at a third party
+	peer := c.conn.RemoteAddr().(*net.TCPAddr).IP
+	remote := req.senderAddr
+	if req.confSender {
+		remote = req.receiverAddr
+	}
+	if !remote.Equal(peer) {
+		return srv.rejectSession(c, owampAcceptProhibited)
+	}
+	if srv.cfg.maxPackets > 0 && uint64(req.numPackets) > srv.cfg.maxPackets {
+		return srv.rejectSession(c, owampAcceptPermLimit)
+	}
+	if !srv.reserveSessions(1) {
+		return srv.rejectSession(c, owampAcceptTempLimit)
+	}
+
+	network := "udp4"
+	if req.ipVersion == 6 {
+		network = "udp6"
+	}
+	localIP := c.conn.LocalAddr().(*net.TCPAddr).IP
+	conn, err := listenUDPInRange(network, localIP, srv.cfg.portRangeMin, srv.cfg.portRangeMax)
+	if err != nil {
+		srv.releaseSessions(1)
+		return srv.rejectSession(c, owampAcceptTempLimit)
+	}
+	port := uint16(conn.LocalAddr().(*net.UDPAddr).Port)
+
+	if req.confReceiver {
+		// we are the receiver, so we assign the SID
+		req.sid = newSID()
+		req.receiverPort = port
+	} else {
+		req.senderPort = port
+	}
+	// the SID chosen by a receiving client must not replace a session of the connection,
+	// its socket and reservation would never be released
+	if _, found := sessions[req.sid]; found {
+		conn.Close()
+		srv.releaseSessions(1)
+		return srv.rejectSession(c, owampAcceptFailure)
+	}
+
+	sessions[req.sid] = &serverSession{
+		req:  req,
+		conn: conn,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	atomic.AddUint64(&srv.stats.sessionsTotal, 1)
+
+	resp := make([]byte, owampAcceptSessionSize)
+	resp[0] = owampAcceptOK
+	binary.BigEndian.PutUint16(resp[2:4], port)
+	copy(resp[4:20], req.sid[:])
+	return c.write(resp)
+}
+
+func (srv *OWAMPServer) handleStartSessions(c *owampConn, sessions map[[16]byte]*serverSession) error {
+	if _, err := c.read(owampStartSessionsSize - 16); err != nil {
+		return err
+	}
+	for _, sess := range sessions {
+		if sess.started {
+			continue
+		}
+		sess.started = true
+		atomic.AddInt64(&srv.stats.sessionsActive, 1)
+		if sess.req.confReceiver {
+			go srv.runReceiver(sess)
+		} else {
+			go srv.runSender(sess)
+		}
+	}
+	resp := make([]byte, owampStartAckSize)
+	resp[0] = owampAcceptOK
+	return c.write(resp)
+}
+
+func (srv *OWAMPServer) handleStopSessions(c *owampConn, hdr []byte, sessions map[[16]byte]*serverSession) error {
+	_, descs, err := readStopSessions(c, hdr)
+	if err != nil {
+		return err
+	}
+	nextSeqNos := make(map[[16]byte]uint32)
+	for _, desc := range descs {
+		nextSeqNos[desc.sid] = desc.nextSeqNo
+	}
+
+	ret := make([]owampSessionDesc, 0, len(sessions))
+	for sid, sess := range sessions {
+		srv.finishSession(sess)
+		if sess.req.confReceiver {
+			if nextSeqNo, ok := nextSeqNos[sid]; ok && nextSeqNo <= sess.req.numPackets {
+				sess.req.nextSeqNo = nextSeqNo
+			} else {
+				sess.req.nextSeqNo = sess.req.numPackets
+			}
+			sess.req.records = fillLostRecords(sess.records, &sess.req)
+		} else {
+			ret = append(ret, owampSessionDesc{sid: sid, nextSeqNo: sess.sent})
+		}
+	}
+	return c.write(encodeStopSessions(owampAcceptOK, ret))
+}
+
+func (srv *OWAMPServer) handleFetchSession(c *owampConn, hdr []byte, sessions map[[16]byte]*serverSession) error {
+	b, err := c.read(owampFetchSessionSize - 16)
+	if err != nil {
+		return err
+	}
+	begin := binary.BigEndian.Uint32(hdr[8:12])
+	end := binary.BigEndian.Uint32(hdr[12:16])
+	var sid [16]byte
+	copy(sid[:], b[0:16])
+
+	ack := make([]byte, owampFetchAckSize)
+	sess, ok := sessions[sid]
+	if !ok || !sess.req.confReceiver || sess.req.records == nil {
+		ack[0] = owampAcceptFailure
+		return c.write(ack)
+	}
+
+	records := make([]OWPRecord, 0, len(sess.req.records))
+	for _, rec := range sess.req.records {
+		if rec.seqNo >= begin && rec.seqNo <= end {
+			records = append(records, rec)
+		}
+	}
+
+	ack[0] = owampAcceptOK
+	ack[1] = 1
+	binary.BigEndian.PutUint32(ack[4:8], sess.req.nextSeqNo)
+	binary.BigEndian.PutUint32(ack[8:12], uint32(len(sess.req.skipRanges)))
+	binary.BigEndian.PutUint32(ack[12:16], uint32(len(records)))
+
+	msg := append(ack, encodeSkipRanges(sess.req.skipRanges)...)
+	msg = append(msg, make([]byte, owampHMACSize)...)
+	rb := make([]byte, owampPadded(len(records)*owpDataRecordSize)+owampHMACSize)
+	for i := range records {
+		encodeOWPRecord(rb[i*owpDataRecordSize:], &records[i])
+	}
+	msg = append(msg, rb...)
+	return c.write(msg)
+}
+
+// stop the sender/receiver of the session and wait for it to finish
+func (srv *OWAMPServer) finishSession(sess *serverSession) {
+	select {
+	case <-sess.stop:
+		return
+	default:
+	}
+	close(sess.stop)
+	sess.conn.Close()
+	if sess.started {
+		<-sess.done
+		atomic.AddInt64(&srv.stats.sessionsActive, -1)
+	}
+}
+
+func (srv *OWAMPServer) runReceiver(sess *serverSession) {
+	defer close(sess.done)
+
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := sess.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		recvTime := OWTimestampFromTime(time.Now())
+		seq, sendTime, errEst, err := parseTestPacket(buf[:n])
+		if err != nil || seq >= sess.req.numPackets {
+			atomic.AddUint64(&srv.stats.packetsMalformed, 1)
+			continue
+		}
+		// keep at most one duplicate per packet on average
+		if uint64(len(sess.records)) >= 2*uint64(sess.req.numPackets) {
+			atomic.AddUint64(&srv.stats.packetsMalformed, 1)
+			continue
+		}
+		atomic.AddUint64(&srv.stats.packetsReceived, 1)
+		sess.records = append(sess.records, OWPRecord{
+			seqNo:      seq,
+			sendTime:   sendTime,
+			sendErrEst: errEst,
+			recvTime:   recvTime,
+			recvErrEst: owampDefaultErrEstimate,
+			ttl:        owpTTLUnknown,
+		})
+	}
+}
+
+func (srv *OWAMPServer) runSender(sess *serverSession) {
+	defer close(sess.done)
+
+	addr := &net.UDPAddr{IP: sess.req.receiverAddr, Port: int(sess.req.receiverPort)}
+	buf := make([]byte, owampTestPacketSize+int(sess.req.paddingLength))
+	sendTime := sess.req.startTime.Time()
+	for seq := uint32(0); seq < sess.req.numPackets; seq++ {
+		sendTime = sendTime.Add(slotInterval(sess.req.slots[int(seq)%len(sess.req.slots)]))
+		select {
+		case <-sess.stop:
+			return
+		case <-time.After(time.Until(sendTime)):
+		}
+		encodeTestPacket(buf, seq, OWTimestampFromTime(time.Now()), owampDefaultErrEstimate)
+		if _, err := sess.conn.WriteToUDP(buf, addr); err != nil {
+			return
+		}
+		sess.sent = seq + 1
+		atomic.AddUint64(&srv.stats.packetsSent, 1)
+	}
+}
+
+// time until the next packet according to a schedule slot
+func slotInterval(slot OWPSlot) time.Duration {
+	mean := float64(slot.interval) / (1 << 32)
+	if slot.slotType == owpSlotRandExp {
+		return time.Duration(rand.ExpFloat64() * mean * float64(time.Second))
+	}
+	return time.Duration(mean * float64(time.Second))
+}
+
+// add records for the packets up to the next sequence number which were never received
+func fillLostRecords(records []OWPRecord, sess *OWPSession) []OWPRecord {
+	received := make(map[uint32]bool)
+	for _, rec := range records {
+		received[rec.seqNo] = true
+	}
+	ret := append(make([]OWPRecord, 0, sess.nextSeqNo), records...)
+	for seq := uint32(0); seq < sess.nextSeqNo; seq++ {
+		if !received[seq] {
+			ret = append(ret, OWPRecord{seqNo: seq, ttl: owpTTLUnknown})
+		}
+	}
+	return ret
+}
+
+func (srv *OWAMPServer) WriteMetrics(me metricEmitter) {
+	stats := []struct {
+		name  string
+		value int64
+	}{
+		{"owamp_responder_connections_total", int64(atomic.LoadUint64(&srv.stats.connectionsTotal))},
+		{"owamp_responder_connections_active", atomic.LoadInt64(&srv.stats.connectionsActive)},
+		{"owamp_responder_sessions_total", int64(atomic.LoadUint64(&srv.stats.sessionsTotal))},
+		{"owamp_responder_sessions_active", atomic.LoadInt64(&srv.stats.sessionsActive)},
+		{"owamp_responder_sessions_rejected_total", int64(atomic.LoadUint64(&srv.stats.sessionsRejected))},
+		{"owamp_responder_packets_received_total", int64(atomic.LoadUint64(&srv.stats.packetsReceived))},
+		{"owamp_responder_packets_sent_total", int64(atomic.LoadUint64(&srv.stats.packetsSent))},
+		{"owamp_responder_packets_malformed_total", int64(atomic.LoadUint64(&srv.stats.packetsMalformed))},
+		{"owamp_responder_control_errors_total", int64(atomic.LoadUint64(&srv.stats.controlErrorsTotal))},
+	}
+	for _, stat := range stats {
+		me.add(stat.name, nil, float64(stat.value))
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOWAMPServerRejectsSessions(t *testing.T) {
+	tests := []struct {
+		name   string
+		cfg    ResponderCfg
+		modify func(req *OWPSession)
+	}{
+		// the test packets may only be exchanged with the peer of the control connection
+		{"third party sender", ResponderCfg{}, func(req *OWPSession) { req.senderAddr = net.ParseIP("192.0.2.1") }},
+		{"third party receiver", ResponderCfg{}, func(req *OWPSession) {
+			req.confSender, req.confReceiver = true, false
+			req.receiverAddr = net.ParseIP("192.0.2.1")
+		}},
+		{"both sides configured", ResponderCfg{}, func(req *OWPSession) { req.confSender = true }},
+		{"too many packets", ResponderCfg{maxPackets: testPackets - 1}, func(req *OWPSession) {}},
+	}
+
+	for _, tt := range tests {
+		_, address := startTestOWAMPServer(t, tt.cfg)
+		client := dialTestOWAMPServer(t, address)
+		conn := listenTestUDP(t)
+
+		req := testSessionRequest(true, conn)
+		tt.modify(&req)
+		if _, _, err := client.RequestSession(&req); err == nil {
+			t.Errorf("%s: session request accepted", tt.name)
+		}
+	}
+}
+
+func TestOWAMPServerSessionLimit(t *testing.T) {
+	srv, address := startTestOWAMPServer(t, ResponderCfg{maxSessions: 1})
+	client := dialTestOWAMPServer(t, address)
+	conn := listenTestUDP(t)
+
+	req := testSessionRequest(true, conn)
+	if _, _, err := client.RequestSession(&req); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := client.RequestSession(&req); err == nil {
+		t.Error("second session accepted beyond max-sessions")
+	}
+
+	// the sessions of a connection are released when it is closed
+	client.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for !srv.reserveSessions(1) {
+		if time.Now().After(deadline) {
+			t.Fatal("session not released after closing the control connection")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// a SID chosen by the receiving client can only be used once per connection
+func TestOWAMPServerDuplicateSID(t *testing.T) {
+	srv, address := startTestOWAMPServer(t, ResponderCfg{})
+	client := dialTestOWAMPServer(t, address)
+	conn := listenTestUDP(t)
+
+	req := testSessionRequest(false, conn)
+	if _, _, err := client.RequestSession(&req); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := client.RequestSession(&req); err == nil {
+		t.Error("session with a duplicate SID accepted")
+	}
+	srv.mutex.Lock()
+	reserved := srv.sessions
+	srv.mutex.Unlock()
+	if reserved != 1 || srv.stats.sessionsTotal != 1 || srv.stats.sessionsRejected != 1 {
+		t.Errorf("%d sessions reserved, %d accepted and %d rejected, want 1, 1 and 1",
+			reserved, srv.stats.sessionsTotal, srv.stats.sessionsRejected)
+	}
+
+	// all reservations are released when the connection is closed
+	client.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		srv.mutex.Lock()
+		reserved = srv.sessions
+		srv.mutex.Unlock()
+		if reserved == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d sessions still reserved after closing the control connection", reserved)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestOWAMPServerDuplicateCap(t *testing.T) {
+	_, address := startTestOWAMPServer(t, ResponderCfg{})
+	client := dialTestOWAMPServer(t, address)
+	conn := listenTestUDP(t)
+
+	req := testSessionRequest(true, conn)
+	port, sid, err := client.RequestSession(&req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = client.StartSessions(); err != nil {
+		t.Fatal(err)
+	}
+
+	// every packet sent ten times, only two records per packet are kept on average
+	buf := make([]byte, owampTestPacketSize)
+	addr := &net.UDPAddr{IP: req.receiverAddr, Port: int(port)}
+	for i := 0; i < 10; i++ {
+		for seq := uint32(0); seq < testPackets; seq++ {
+			encodeTestPacket(buf, seq, OWTimestampFromTime(time.Now()), owampDefaultErrEstimate)
+			if _, err = conn.WriteToUDP(buf, addr); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if _, err = client.StopSessions([]owampSessionDesc{{sid: sid, nextSeqNo: testPackets}}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := client.FetchSession(sid, 0, 0xffffffff, testPackets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data.records) != 2*testPackets {
+		t.Errorf("got %d records, want %d", len(data.records), 2*testPackets)
+	}
+}
+
+func TestFillLostRecords(t *testing.T) {
+	sess := OWPSession{nextSeqNo: 4}
+	records := []OWPRecord{{seqNo: 2, recvTime: 1}, {seqNo: 0, recvTime: 1}}
+	want := []OWPRecord{
+		{seqNo: 2, recvTime: 1},
+		{seqNo: 0, recvTime: 1},
+		{seqNo: 1, ttl: owpTTLUnknown},
+		{seqNo: 3, ttl: owpTTLUnknown},
+	}
+	if got := fillLostRecords(records, &sess); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
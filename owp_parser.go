@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+// parser for the binary OWAMP session data files (.owp) as written by powstream/owampd
+//
+// Only version 3 of the file format is supported, which is the format all current
+// versions of the owamp toolkit write. The layout of the file is:
+//
+//	header (48 bytes):
+//	  magic "OwA\0", version, header length (64bit), finished flag, next seqno,
+//	  number of skip ranges, number of data records,
+//	  offset of skip ranges (64bit), offset of data records (64bit)
+//	test request (112 bytes, RFC 4656 Request-Session message)
+//	schedule slots (16 bytes each)
+//	skip ranges (8 bytes each)
+//	data records (25 bytes each)
+//
+// All values are in network byte order.
+
+// reasons of data file parse errors as used in the error metrics
+const (
+	owpErrRead    = "owp_read"
+	owpErrInvalid = "owp_invalid"
+)
+
+const (
+	owpFileVersion     = 3
+	owpFileHeaderSize  = 48
+	owpTestRequestSize = 112
+	owpSlotSize        = 16
+	owpSkipRangeSize   = 8
+	owpDataRecordSize  = 25
+	owpTTLUnknown      = 255
+
+	// schedule slot types
+	owpSlotRandExp = 0
+	owpSlotLiteral = 1
+)
+
+var owpFileMagic = []byte{'O', 'w', 'A', 0}
+
+type OWPSlot struct {
+	slotType uint8
+	interval uint64
+}
+
+type OWPSkipRange struct {
+	begin uint32
+	end   uint32
+}
+
+type OWPRecord struct {
+	seqNo      uint32
+	sendTime   OWTimestamp
+	sendErrEst uint16
+	recvTime   OWTimestamp
+	recvErrEst uint16
+	ttl        uint8
+}
+
+type OWPSession struct {
+	version   uint32
+	finished  uint32
+	nextSeqNo uint32
+
+	// test request parameters
+	ipVersion     uint8
+	confSender    bool
+	confReceiver  bool
+	numPackets    uint32
+	senderAddr    net.IP
+	senderPort    uint16
+	receiverAddr  net.IP
+	receiverPort  uint16
+	sid           [16]byte
+	paddingLength uint32
+	startTime     OWTimestamp
+	lossTimeout   uint64
+	typeP         uint32
+
+	slots      []OWPSlot
+	skipRanges []OWPSkipRange
+	records    []OWPRecord
+}
+
+// a packet is considered lost when the receive timestamp has not been filled in
+func (rec *OWPRecord) lost() bool {
+	return rec.recvTime == 0
+}
+
+// one-way delay of the packet in seconds
+func (rec *OWPRecord) delay() float64 {
+	return rec.recvTime.Sub(rec.sendTime)
+}
+
+// decode an OWAMP error estimate (RFC 4656 section 4.1.2) into seconds
+func owpErrEstimate(e uint16) float64 {
+	scale := uint(e>>8) & 0x3f
+	multiplier := float64(e & 0xff)
+	return multiplier * float64(uint64(1)<<scale) / (1 << 32)
+}
+
+// check the S bit of an OWAMP error estimate
+func owpErrEstimateSynced(e uint16) bool {
+	return e&0x8000 != 0
+}
+
+func parseOWPAddress(ipVersion uint8, b []byte) net.IP {
+	if ipVersion == 6 {
+		return net.IP(append([]byte(nil), b[:16]...))
+	}
+	return net.IPv4(b[0], b[1], b[2], b[3])
+}
+
+func parseOWPRecord(b []byte) OWPRecord {
+	return OWPRecord{
+		seqNo:      binary.BigEndian.Uint32(b[0:4]),
+		sendTime:   OWTimestamp(binary.BigEndian.Uint64(b[4:12])),
+		sendErrEst: binary.BigEndian.Uint16(b[12:14]),
+		recvTime:   OWTimestamp(binary.BigEndian.Uint64(b[14:22])),
+		recvErrEst: binary.BigEndian.Uint16(b[22:24]),
+		ttl:        b[24],
+	}
+}
+
+// decode the test request and return the number of schedule slots following it
+func parseOWPTestRequest(ret *OWPSession, b []byte) (uint32, error) {
+	if b[0] != 1 {
+		return 0, errors.New("invalid owp test request. Unexpected command number.")
+	}
+	ret.ipVersion = b[1] & 0x0f
+	if ret.ipVersion != 4 && ret.ipVersion != 6 {
+		return 0, errors.New("invalid owp test request. Unknown IP version.")
+	}
+	ret.confSender = b[2] != 0
+	ret.confReceiver = b[3] != 0
+	numSlots := binary.BigEndian.Uint32(b[4:8])
+	ret.numPackets = binary.BigEndian.Uint32(b[8:12])
+	ret.senderPort = binary.BigEndian.Uint16(b[12:14])
+	ret.receiverPort = binary.BigEndian.Uint16(b[14:16])
+	ret.senderAddr = parseOWPAddress(ret.ipVersion, b[16:32])
+	ret.receiverAddr = parseOWPAddress(ret.ipVersion, b[32:48])
+	copy(ret.sid[:], b[48:64])
+	ret.paddingLength = binary.BigEndian.Uint32(b[64:68])
+	ret.startTime = OWTimestamp(binary.BigEndian.Uint64(b[68:76]))
+	ret.lossTimeout = binary.BigEndian.Uint64(b[76:84])
+	ret.typeP = binary.BigEndian.Uint32(b[84:88])
+
+	return numSlots, nil
+}
+
+func ParseOWPFile(data []byte) (OWPSession, error) {
+	ret := OWPSession{}
+
+	if len(data) < owpFileHeaderSize {
+		return ret, errors.New("invalid owp file. File too short.")
+	}
+	if !bytes.Equal(data[0:4], owpFileMagic) {
+		return ret, errors.New("invalid owp file. Bad magic.")
+	}
+	ret.version = binary.BigEndian.Uint32(data[4:8])
+	if ret.version != owpFileVersion {
+		return ret, errors.New("invalid owp file. Unsupported file version.")
+	}
+	hdrLen := binary.BigEndian.Uint64(data[8:16])
+	ret.finished = binary.BigEndian.Uint32(data[16:20])
+	ret.nextSeqNo = binary.BigEndian.Uint32(data[20:24])
+	numSkipRanges := uint64(binary.BigEndian.Uint32(data[24:28]))
+	numRecords := uint64(binary.BigEndian.Uint32(data[28:32]))
+	osetSkipRanges := binary.BigEndian.Uint64(data[32:40])
+	osetRecords := binary.BigEndian.Uint64(data[40:48])
+
+	if hdrLen > uint64(len(data)) {
+		return ret, errors.New("invalid owp file. Truncated header.")
+	}
+
+	// decode the test request and the schedule following it
+	if hdrLen >= owpFileHeaderSize+owpTestRequestSize {
+		numSlots, err := parseOWPTestRequest(&ret, data[owpFileHeaderSize:owpFileHeaderSize+owpTestRequestSize])
+		if err != nil {
+			return ret, err
+		}
+		slotsOffset := uint64(owpFileHeaderSize + owpTestRequestSize)
+		if slotsOffset+uint64(numSlots)*owpSlotSize > hdrLen {
+			return ret, errors.New("invalid owp file. Truncated schedule.")
+		}
+		ret.slots = make([]OWPSlot, numSlots)
+		for i := range ret.slots {
+			b := data[slotsOffset+uint64(i)*owpSlotSize:]
+			ret.slots[i].slotType = b[0]
+			ret.slots[i].interval = binary.BigEndian.Uint64(b[8:16])
+		}
+	}
+
+	// decode skip ranges
+	if numSkipRanges > 0 {
+		// the offset is checked first, the sum could overflow otherwise
+		if osetSkipRanges > uint64(len(data)) || numSkipRanges > (uint64(len(data))-osetSkipRanges)/owpSkipRangeSize {
+			return ret, errors.New("invalid owp file. Truncated skip ranges.")
+		}
+		ret.skipRanges = make([]OWPSkipRange, numSkipRanges)
+		for i := range ret.skipRanges {
+			b := data[osetSkipRanges+uint64(i)*owpSkipRangeSize:]
+			ret.skipRanges[i].begin = binary.BigEndian.Uint32(b[0:4])
+			ret.skipRanges[i].end = binary.BigEndian.Uint32(b[4:8])
+		}
+	}
+
+	// decode the data records
+	if osetRecords == 0 {
+		osetRecords = hdrLen
+	}
+	if osetRecords > uint64(len(data)) {
+		return ret, errors.New("invalid owp file. Data records offset beyond end of file.")
+	}
+	// files of still running sessions do not have the number of records filled in
+	if numRecords == 0 {
+		numRecords = (uint64(len(data)) - osetRecords) / owpDataRecordSize
+	}
+	if numRecords > (uint64(len(data))-osetRecords)/owpDataRecordSize {
+		return ret, errors.New("invalid owp file. Truncated data records.")
+	}
+	ret.records = make([]OWPRecord, numRecords)
+	for i := range ret.records {
+		ret.records[i] = parseOWPRecord(data[osetRecords+uint64(i)*owpDataRecordSize:])
+	}
+
+	return ret, nil
+}
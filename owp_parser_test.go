@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// encode a session as version 3 .owp file, the layout as described in owp_parser.go
+func encodeOWPFile(sess *OWPSession) []byte {
+	// the file contains the Request-Session message without the trailing HMAC
+	req := encodeOWPTestRequest(sess)
+	req = req[:len(req)-owampHMACSize]
+	hdrLen := owpFileHeaderSize + len(req)
+	osetSkipRanges := hdrLen
+	osetRecords := osetSkipRanges + len(sess.skipRanges)*owpSkipRangeSize
+
+	b := make([]byte, osetRecords+len(sess.records)*owpDataRecordSize)
+	copy(b[0:4], owpFileMagic)
+	binary.BigEndian.PutUint32(b[4:8], owpFileVersion)
+	binary.BigEndian.PutUint64(b[8:16], uint64(hdrLen))
+	binary.BigEndian.PutUint32(b[16:20], sess.finished)
+	binary.BigEndian.PutUint32(b[20:24], sess.nextSeqNo)
+	binary.BigEndian.PutUint32(b[24:28], uint32(len(sess.skipRanges)))
+	binary.BigEndian.PutUint32(b[28:32], uint32(len(sess.records)))
+	binary.BigEndian.PutUint64(b[32:40], uint64(osetSkipRanges))
+	binary.BigEndian.PutUint64(b[40:48], uint64(osetRecords))
+	copy(b[owpFileHeaderSize:], req)
+	for i, sr := range sess.skipRanges {
+		binary.BigEndian.PutUint32(b[osetSkipRanges+i*owpSkipRangeSize:], sr.begin)
+		binary.BigEndian.PutUint32(b[osetSkipRanges+i*owpSkipRangeSize+4:], sr.end)
+	}
+	for i := range sess.records {
+		encodeOWPRecord(b[osetRecords+i*owpDataRecordSize:], &sess.records[i])
+	}
+	return b
+}
+
+func testOWPSession(ip net.IP) OWPSession {
+	start := OWTimestamp(0xe0f1a2b300000000)
+	return OWPSession{
+		version:       owpFileVersion,
+		finished:      1,
+		nextSeqNo:     3,
+		ipVersion:     owampIPVersion(ip),
+		numPackets:    3,
+		senderAddr:    ip,
+		senderPort:    9000,
+		receiverAddr:  ip,
+		receiverPort:  9001,
+		sid:           [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+		paddingLength: 14,
+		startTime:     start,
+		lossTimeout:   10 << 32,
+		typeP:         46,
+		slots:         []OWPSlot{{slotType: owpSlotRandExp, interval: 1 << 28}},
+		skipRanges:    []OWPSkipRange{{begin: 1, end: 1}},
+		records: []OWPRecord{
+			{seqNo: 0, sendTime: start, sendErrEst: 0x8001, recvTime: start + 1<<22, recvErrEst: 0x8001, ttl: 64},
+			{seqNo: 2, sendTime: start + 2<<28, sendErrEst: 0x8001, ttl: owpTTLUnknown},
+		},
+	}
+}
+
+func TestParseOWPFile(t *testing.T) {
+	for _, ip := range []net.IP{net.ParseIP("192.0.2.1").To4(), net.ParseIP("2001:db8::1")} {
+		want := testOWPSession(ip)
+		got, err := ParseOWPFile(encodeOWPFile(&want))
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", ip, err)
+		}
+		// parseOWPAddress always returns the 16 byte form
+		want.senderAddr, want.receiverAddr = want.senderAddr.To16(), want.receiverAddr.To16()
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: parsed session differs\n got: %+v\nwant: %+v", ip, got, want)
+		}
+	}
+}
+
+func TestParseOWPFileRunningSession(t *testing.T) {
+	sess := testOWPSession(net.ParseIP("192.0.2.1"))
+	data := encodeOWPFile(&sess)
+	// sessions still being written have neither the record count nor the offset filled in
+	binary.BigEndian.PutUint32(data[28:32], 0)
+	binary.BigEndian.PutUint64(data[40:48], 0)
+
+	// without skip ranges the records follow the header directly
+	binary.BigEndian.PutUint32(data[24:28], 0)
+	data = append(data[:owpFileHeaderSize+owpTestRequestSize+owpSlotSize], data[len(data)-2*owpDataRecordSize:]...)
+	got, err := ParseOWPFile(data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(got.records, sess.records) {
+		t.Errorf("records = %+v, want %+v", got.records, sess.records)
+	}
+}
+
+func TestParseOWPFileErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func([]byte) []byte
+		err    string
+	}{
+		{"too short", func(b []byte) []byte { return b[:owpFileHeaderSize-1] }, "invalid owp file. File too short."},
+		{"bad magic", func(b []byte) []byte { b[0] = 'X'; return b }, "invalid owp file. Bad magic."},
+		{"version 2", func(b []byte) []byte { binary.BigEndian.PutUint32(b[4:8], 2); return b }, "invalid owp file. Unsupported file version."},
+		{"truncated header", func(b []byte) []byte { return b[:owpFileHeaderSize+owpTestRequestSize] }, "invalid owp file. Truncated header."},
+		{"bad command", func(b []byte) []byte { b[owpFileHeaderSize] = 2; return b }, "invalid owp test request. Unexpected command number."},
+		{"unknown ip version", func(b []byte) []byte { b[owpFileHeaderSize+1] = 5; return b }, "invalid owp test request. Unknown IP version."},
+		{"truncated schedule", func(b []byte) []byte {
+			binary.BigEndian.PutUint32(b[owpFileHeaderSize+4:], 2)
+			return b
+		}, "invalid owp file. Truncated schedule."},
+		{"truncated skip ranges", func(b []byte) []byte {
+			binary.BigEndian.PutUint32(b[24:28], 1000)
+			return b
+		}, "invalid owp file. Truncated skip ranges."},
+		{"skip ranges offset overflow", func(b []byte) []byte {
+			binary.BigEndian.PutUint32(b[24:28], 1)
+			binary.BigEndian.PutUint64(b[32:40], ^uint64(0)-owpSkipRangeSize+1)
+			return b
+		}, "invalid owp file. Truncated skip ranges."},
+		{"records beyond end", func(b []byte) []byte {
+			binary.BigEndian.PutUint64(b[40:48], uint64(len(b)+1))
+			return b
+		}, "invalid owp file. Data records offset beyond end of file."},
+		{"truncated records", func(b []byte) []byte { return b[:len(b)-1] }, "invalid owp file. Truncated data records."},
+	}
+
+	for _, tt := range tests {
+		sess := testOWPSession(net.ParseIP("192.0.2.1"))
+		_, err := ParseOWPFile(tt.modify(encodeOWPFile(&sess)))
+		if err == nil || err.Error() != tt.err {
+			t.Errorf("%s: error = %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestOWPErrEstimate(t *testing.T) {
+	tests := []struct {
+		e      uint16
+		value  float64
+		synced bool
+	}{
+		{0x0000, 0, false},
+		// multiplier 1 with scale 32 is exactly one second
+		{0x2001, 1, false},
+		{0xa001, 1, true},
+		{0x8001, 1.0 / (1 << 32), true},
+	}
+	for _, tt := range tests {
+		if got := owpErrEstimate(tt.e); got != tt.value {
+			t.Errorf("owpErrEstimate(%#04x) = %v, want %v", tt.e, got, tt.value)
+		}
+		if got := owpErrEstimateSynced(tt.e); got != tt.synced {
+			t.Errorf("owpErrEstimateSynced(%#04x) = %v, want %v", tt.e, got, tt.synced)
+		}
+	}
+}
+
+// .owp failures are counted with their own reasons
+func TestParseDataFileErrors(t *testing.T) {
+	dir := t.TempDir()
+	invalid := filepath.Join(dir, "invalid.owp")
+	if err := os.WriteFile(invalid, []byte("OwA"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, reason := range map[string]string{
+		filepath.Join(dir, "missing.owp"): owpErrRead,
+		invalid:                           owpErrInvalid,
+	} {
+		out := make(chan MeasurementReport, 1)
+		if err := ParseDataFile(out, 0, path); err == nil {
+			t.Errorf("%s: parsed", path)
+		}
+		if report := <-out; report.parseError != reason {
+			t.Errorf("%s: reason %q, want %q", path, report.parseError, reason)
+		}
+	}
+}
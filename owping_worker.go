@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+)
+
+// measurement backend running one-shot owping sessions back to back
+
+type OwpingWorker struct {
+	measurementOut chan MeasurementReport
+	measurementIdx uint
+	cfg            Config
+	mcfg           MeasurementCfg
+}
+
+func NewOwpingWorker(cfg Config, idx uint, outCh chan MeasurementReport) *OwpingWorker {
+	return &OwpingWorker{
+		measurementOut: outCh,
+		measurementIdx: idx,
+		cfg:            cfg,
+		mcfg:           cfg.measurements[idx],
+	}
+}
+
+func (w *OwpingWorker) RunWorker(ctx context.Context) {
+	for {
+		summary, err := w.runSession(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		var parseErr *SummaryParseError
+		if errors.As(err, &parseErr) {
+			w.measurementOut <- parseErrorReport(w.measurementIdx, err)
+		}
+		if err != nil {
+			log.Printf("%d owping session failed: %v", w.measurementIdx, err)
+			if !sleepContext(ctx, nativeRetryDelay) {
+				return
+			}
+			continue
+		}
+		w.measurementOut <- summaryMeasurementReport(w.measurementIdx, summary)
+	}
+}
+
+// run a single owping session and parse its machine-readable summary
+func (w *OwpingWorker) runSession(ctx context.Context) (SummaryReport, error) {
+	src := w.cfg.targets[w.mcfg.targetSrc]
+	dst := w.cfg.targets[w.mcfg.targetDst]
+
+	cmdArgs := []string{
+		// number of packets
+		"-c",
+		fmt.Sprintf("%d", w.mcfg.duration*w.mcfg.pps),
+		// interval between packets
+		"-i",
+		fmt.Sprintf("%.6f", 1/float64(w.mcfg.pps)),
+		// port range
+		"-P",
+		fmt.Sprintf("%d-%d", w.cfg.portRangeMin, w.cfg.portRangeMax),
+		// bucket width of the latency histogram
+		"-b",
+		w.mcfg.bucketWidth,
+		// machine-readable summary on stdout
+		"-M",
+	}
+
+	// owping only measures between the local host and the OWAMP server
+	if src.local {
+		cmdArgs = append(cmdArgs, "-t", dst.hostname)
+	} else if dst.local {
+		cmdArgs = append(cmdArgs, "-f", src.hostname)
+	} else {
+		return SummaryReport{}, errors.New("owping backend requires either source or destination to be local")
+	}
+
+	cmd := exec.CommandContext(ctx, w.cfg.owpingCmd, cmdArgs...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		printErrorMsgs("owping", &stderr)
+		return SummaryReport{}, err
+	}
+	return ParseSummary(bufio.NewReader(bytes.NewReader(out)))
+}
@@ -7,40 +7,114 @@ import (
 	"strings"
 )
 
+// major version of the owstats summary format understood by the parser
+const summaryVersionMajor = "3"
+
+// reasons of summary parse errors as used in the error metrics
+const (
+	summaryErrRead               = "read"
+	summaryErrIncomplete         = "incomplete"
+	summaryErrUnsupportedVersion = "unsupported_version"
+	summaryErrInvalidValue       = "invalid_value"
+	summaryErrInvalidSection     = "invalid_section"
+)
+
+type SummaryParseError struct {
+	reason string
+	msg    string
+}
+
+func newSummaryParseError(reason string, msg string) error {
+	return &SummaryParseError{reason: reason, msg: msg}
+}
+
+func (e *SummaryParseError) Error() string {
+	return e.msg
+}
+
+// reason of a summary parse error for the error metrics
+func summaryErrorReason(err error) string {
+	var parseErr *SummaryParseError
+	if errors.As(err, &parseErr) {
+		return parseErr.reason
+	}
+	return summaryErrRead
+}
+
 type SummaryReport struct {
-	startTime float64
-	endTime   float64
+	summaryVersion string
 
-	sentPkts uint64
-	dupPkts  uint64
-	lostPkts uint64
+	// session information
+	sid      string
+	fromHost string
+	fromAddr string
+	fromPort string
+	toHost   string
+	toAddr   string
+	toPort   string
+
+	startTime OWTimestamp
+	endTime   OWTimestamp
+
+	// test parameters
+	dscp          uint64
+	lossTimeout   uint64
+	packetPadding uint64
+	sessionPkts   uint64
+	samplePkts    uint64
+	finished      bool
+	sync          bool
+
+	sentPkts  uint64
+	dupPkts   uint64
+	lostPkts  uint64
+	errorPkts uint64
 
 	maxErr float64
 
 	latencyMin float64
 	latencyMax float64
 	latencyMed float64
+	latencyPDV float64
+
+	ttlMin uint64
+	ttlMax uint64
 
 	latencyHistWidth float64
 	latencyHist      []HistogramEntry
 	ttlHist          []HistogramEntry
 	reorderingHist   []HistogramEntry
+
+	// tables of the other sections by their lowercase name, e.g. "newsection" for <NEWSECTION>
+	sections map[string][]SummarySectionRow
+
+	// number of keys not understood by the parser
+	unknownKeys uint64
 }
 
 type HistogramEntry struct {
-	key   uint64
+	key   int64
 	value uint64
 }
 
-// convert a OWAMP/owstats timestamp into a milliseconds UNIX time suitable for prometheus/openmetrics
-// the input time stamp has the upper 32bit being the unix timestamp
-// and the lower 32bit the fractional time
-func parseOWTimestamp(t uint64) uint64 {
-	// upper 32bit converted to milliseconds
-	upper := (t >> 32) * 1000
+// row of a section table, the first column identifies the row
+type SummarySectionRow struct {
+	key    string
+	values []float64
+}
 
-	// TODO: decode the lower 32bit and convert to milliseconds
-	return upper
+// count the packets in the negative latency buckets of the histogram and the total number of packets
+// (negative one-way delays are a sign of unsynchronized clocks between the two hosts)
+func (s *SummaryReport) negativeLatencyPackets() (uint64, uint64) {
+	var negative uint64 = 0
+	var total uint64 = 0
+	for _, entry := range s.latencyHist {
+		if entry.key < 0 {
+			negative += entry.value
+		}
+		total += entry.value
+	}
+	return negative, total
 }
 
 func ParseHistogram(s *bufio.Scanner) ([]HistogramEntry, error) {
@@ -58,7 +132,7 @@ func ParseHistogram(s *bufio.Scanner) ([]HistogramEntry, error) {
 		if len(parts) != 2 {
 			return data, errors.New("invalid histogram. Syntax error; invalid entry length.")
 		}
-		key, err := strconv.ParseUint(parts[0], 10, 64)
+		key, err := strconv.ParseInt(parts[0], 10, 64)
 		if err != nil {
 			return data, errors.New("invalid histogram. Syntax error in key.")
 		}
@@ -72,10 +146,56 @@ func ParseHistogram(s *bufio.Scanner) ([]HistogramEntry, error) {
 	return data, errors.New("incomplete histogram. Missing closing bracket.")
 }
 
+// parse the table of a section with any number of value columns up to its closing tag
+func ParseSection(s *bufio.Scanner, name string) ([]SummarySectionRow, error) {
+	closing := "</" + strings.TrimPrefix(name, "<")
+	data := make([]SummarySectionRow, 0)
+	keys := make(map[string]bool)
+
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == closing {
+			return data, nil
+		}
+
+		parts := strings.Fields(line)
+		if len(parts) == 0 {
+			continue
+		}
+		if len(parts) < 2 {
+			return data, errors.New("invalid section " + name + ". Syntax error; invalid entry length.")
+		}
+		if keys[parts[0]] {
+			return data, errors.New("invalid section " + name + ". Duplicate key " + parts[0] + ".")
+		}
+		keys[parts[0]] = true
+		row := SummarySectionRow{key: parts[0], values: make([]float64, len(parts)-1)}
+		for i, part := range parts[1:] {
+			value, err := strconv.ParseFloat(part, 64)
+			if err != nil {
+				return data, errors.New("invalid section " + name + ". Syntax error in value.")
+			}
+			row.values[i] = value
+		}
+		data = append(data, row)
+	}
+
+	return data, errors.New("incomplete section " + name + ". Missing closing bracket.")
+}
+
+// parse a boolean flag written as integer
+func parseFlag(value string) (bool, error) {
+	v, err := strconv.ParseUint(value, 10, 64)
+	return v != 0, err
+}
+
 func ParseSummary(r *bufio.Reader) (SummaryReport, error) {
 	var err error
 	ret := SummaryReport{}
 
+	// the UNIX timestamps are only used as fallback for the full-precision OWAMP timestamps
+	var unixStartTime, unixEndTime float64
+
 	s := bufio.NewScanner(r)
 
 	for s.Scan() {
@@ -84,72 +204,165 @@ func ParseSummary(r *bufio.Reader) (SummaryReport, error) {
 		var entryValue string
 		if len(parts) == 0 {
 			continue
-		} else if len(parts) == 2 {
-			entryValue = parts[1]
 		} else if len(parts) == 1 {
 			entryValue = ""
 		} else {
-			continue
+			// values containing whitespace (e.g. hostnames) span multiple fields
+			entryValue = strings.Join(parts[1:], " ")
 		}
 
 		switch parts[0] {
+		case "SUMMARY", "SUMMARY_VERSION":
+			ret.summaryVersion = entryValue
+			if major, _, _ := strings.Cut(entryValue, "."); major != summaryVersionMajor {
+				return ret, newSummaryParseError(summaryErrUnsupportedVersion, "Unsupported summary version "+entryValue)
+			}
+		case "SID":
+			ret.sid = entryValue
+		case "FROM_HOST":
+			ret.fromHost = entryValue
+		case "FROM_ADDR":
+			ret.fromAddr = entryValue
+		case "FROM_PORT":
+			ret.fromPort = entryValue
+		case "TO_HOST":
+			ret.toHost = entryValue
+		case "TO_ADDR":
+			ret.toAddr = entryValue
+		case "TO_PORT":
+			ret.toPort = entryValue
+		case "START_TIME":
+			if ret.startTime, err = ParseOWTimestamp(entryValue); err != nil {
+				return ret, newSummaryParseError(summaryErrInvalidValue, "Invalid start_time. Parse error")
+			}
+		case "END_TIME":
+			if ret.endTime, err = ParseOWTimestamp(entryValue); err != nil {
+				return ret, newSummaryParseError(summaryErrInvalidValue, "Invalid end_time. Parse error")
+			}
 		case "UNIX_START_TIME":
-			if ret.startTime, err = strconv.ParseFloat(entryValue, 64); err != nil {
-				return ret, errors.New("Invalid start_time. Parse error")
+			if unixStartTime, err = strconv.ParseFloat(entryValue, 64); err != nil {
+				return ret, newSummaryParseError(summaryErrInvalidValue, "Invalid unix_start_time. Parse error")
 			}
-			//ret.startTime = parseOWTimestamp(ret.startTime)
 		case "UNIX_END_TIME":
-			if ret.endTime, err = strconv.ParseFloat(entryValue, 64); err != nil {
-				return ret, errors.New("Invalid end_time. Parse error")
+			if unixEndTime, err = strconv.ParseFloat(entryValue, 64); err != nil {
+				return ret, newSummaryParseError(summaryErrInvalidValue, "Invalid unix_end_time. Parse error")
+			}
+		case "DSCP":
+			if ret.dscp, err = strconv.ParseUint(entryValue, 0, 8); err != nil {
+				return ret, newSummaryParseError(summaryErrInvalidValue, "Invalid dscp. Parse error")
+			}
+		case "LOSS_TIMEOUT":
+			if ret.lossTimeout, err = strconv.ParseUint(entryValue, 10, 64); err != nil {
+				return ret, newSummaryParseError(summaryErrInvalidValue, "Invalid loss_timeout. Parse error")
+			}
+		case "PACKET_PADDING":
+			if ret.packetPadding, err = strconv.ParseUint(entryValue, 10, 64); err != nil {
+				return ret, newSummaryParseError(summaryErrInvalidValue, "Invalid packet_padding. Parse error")
+			}
+		case "SESSION_PACKET_COUNT":
+			if ret.sessionPkts, err = strconv.ParseUint(entryValue, 10, 64); err != nil {
+				return ret, newSummaryParseError(summaryErrInvalidValue, "Invalid session_packet_count. Parse error")
+			}
+		case "SAMPLE_PACKET_COUNT":
+			if ret.samplePkts, err = strconv.ParseUint(entryValue, 10, 64); err != nil {
+				return ret, newSummaryParseError(summaryErrInvalidValue, "Invalid sample_packet_count. Parse error")
+			}
+		case "SESSION_FINISHED":
+			if ret.finished, err = parseFlag(entryValue); err != nil {
+				return ret, newSummaryParseError(summaryErrInvalidValue, "Invalid session_finished. Parse error")
+			}
+		case "SYNC":
+			if ret.sync, err = parseFlag(entryValue); err != nil {
+				return ret, newSummaryParseError(summaryErrInvalidValue, "Invalid sync. Parse error")
 			}
-			//ret.endTime = parseOWTimestamp(ret.endTime)
 		case "SENT":
 			if ret.sentPkts, err = strconv.ParseUint(entryValue, 10, 64); err != nil {
-				return ret, errors.New("Invalid sent pkts. Parse error")
+				return ret, newSummaryParseError(summaryErrInvalidValue, "Invalid sent pkts. Parse error")
 			}
 		case "DUPS":
 			if ret.dupPkts, err = strconv.ParseUint(entryValue, 10, 64); err != nil {
-				return ret, errors.New("Invalid dup pkts. Parse error")
+				return ret, newSummaryParseError(summaryErrInvalidValue, "Invalid dup pkts. Parse error")
 			}
 		case "LOST":
 			if ret.lostPkts, err = strconv.ParseUint(entryValue, 10, 64); err != nil {
-				return ret, errors.New("Invalid lost pkts. Parse error")
+				return ret, newSummaryParseError(summaryErrInvalidValue, "Invalid lost pkts. Parse error")
+			}
+		case "ERRORS":
+			if ret.errorPkts, err = strconv.ParseUint(entryValue, 10, 64); err != nil {
+				return ret, newSummaryParseError(summaryErrInvalidValue, "Invalid errors. Parse error")
 			}
 		case "MAXERR":
 			if ret.maxErr, err = strconv.ParseFloat(entryValue, 64); err != nil {
-				return ret, errors.New("Invalid maxerr. Parse error")
+				return ret, newSummaryParseError(summaryErrInvalidValue, "Invalid maxerr. Parse error")
 			}
 		case "MIN":
 			if ret.latencyMin, err = strconv.ParseFloat(entryValue, 64); err != nil {
-				return ret, errors.New("Invalid min. Parse error")
+				return ret, newSummaryParseError(summaryErrInvalidValue, "Invalid min. Parse error")
 			}
 		case "MEDIAN":
 			if ret.latencyMed, err = strconv.ParseFloat(entryValue, 64); err != nil {
-				return ret, errors.New("Invalid median. Parse error")
+				return ret, newSummaryParseError(summaryErrInvalidValue, "Invalid median. Parse error")
 			}
 		case "MAX":
 			if ret.latencyMax, err = strconv.ParseFloat(entryValue, 64); err != nil {
-				return ret, errors.New("Invalid max. Parse error")
+				return ret, newSummaryParseError(summaryErrInvalidValue, "Invalid max. Parse error")
+			}
+		case "PDV":
+			if ret.latencyPDV, err = strconv.ParseFloat(entryValue, 64); err != nil {
+				return ret, newSummaryParseError(summaryErrInvalidValue, "Invalid pdv. Parse error")
+			}
+		case "MINTTL":
+			if ret.ttlMin, err = strconv.ParseUint(entryValue, 10, 64); err != nil {
+				return ret, newSummaryParseError(summaryErrInvalidValue, "Invalid minttl. Parse error")
+			}
+		case "MAXTTL":
+			if ret.ttlMax, err = strconv.ParseUint(entryValue, 10, 64); err != nil {
+				return ret, newSummaryParseError(summaryErrInvalidValue, "Invalid maxttl. Parse error")
 			}
 		case "BUCKET_WIDTH":
 			if ret.latencyHistWidth, err = strconv.ParseFloat(entryValue, 64); err != nil {
-				return ret, errors.New("Invalid bucket_width. Parse error")
+				return ret, newSummaryParseError(summaryErrInvalidValue, "Invalid bucket_width. Parse error")
 			}
 		case "<BUCKETS>":
 			if ret.latencyHist, err = ParseHistogram(s); err != nil {
-				return ret, err
+				return ret, newSummaryParseError(summaryErrInvalidSection, err.Error())
 			}
 
 		case "<TTLBUCKETS>":
 			if ret.ttlHist, err = ParseHistogram(s); err != nil {
-				return ret, err
+				return ret, newSummaryParseError(summaryErrInvalidSection, err.Error())
 			}
 		case "<NREORDERING>":
 			if ret.reorderingHist, err = ParseHistogram(s); err != nil {
-				return ret, err
+				return ret, newSummaryParseError(summaryErrInvalidSection, err.Error())
+			}
+		default:
+			// the tables of the other sections are kept by name, whatever number of columns they have
+			if strings.HasPrefix(parts[0], "<") && !strings.HasPrefix(parts[0], "</") {
+				rows, err := ParseSection(s, parts[0])
+				if err != nil {
+					return ret, newSummaryParseError(summaryErrInvalidSection, err.Error())
+				}
+				if ret.sections == nil {
+					ret.sections = make(map[string][]SummarySectionRow)
+				}
+				ret.sections[strings.ToLower(strings.Trim(parts[0], "<>"))] = rows
+			} else {
+				ret.unknownKeys++
 			}
 		}
 	}
 
+	if ret.summaryVersion == "" {
+		return ret, newSummaryParseError(summaryErrIncomplete, "Missing summary version. Incomplete summary")
+	}
+
+	if ret.startTime.IsZero() && unixStartTime != 0 {
+		ret.startTime = OWTimestampFromUnix(unixStartTime)
+	}
+	if ret.endTime.IsZero() && unixEndTime != 0 {
+		ret.endTime = OWTimestampFromUnix(unixEndTime)
+	}
+
 	return ret, nil
 }
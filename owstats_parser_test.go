@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// summary in the machine readable format of owstats -M, followed by a key unknown to the parser and a section with three columns
+const testSummary = `SUMMARY	3.0
+SUMMARY_VERSION	3.0
+SID	C0000201E0F1A2B3C4D5E6F701234567
+FROM_HOST	sender example
+FROM_ADDR	192.0.2.1
+FROM_PORT	9000
+TO_HOST	receiver
+TO_ADDR	192.0.2.2
+TO_PORT	9001
+START_TIME	E0F1A2B300000000
+END_TIME	E0F1A2BD00000000
+UNIX_START_TIME	1563845224.000
+UNIX_END_TIME	1563845234.000
+DSCP	0x2e
+LOSS_TIMEOUT	42949672960
+PACKET_PADDING	14
+SESSION_PACKET_COUNT	100
+SAMPLE_PACKET_COUNT	100
+SESSION_FINISHED	1
+SYNC	1
+SENT	100
+DUPS	1
+LOST	2
+ERRORS	0
+MAXERR	0.000100
+MIN	0.001
+MEDIAN	0.002
+MAX	0.003
+PDV	0.0005
+MINTTL	63
+MAXTTL	64
+BUCKET_WIDTH	0.0001
+<BUCKETS>
+	-1	1
+	10	90
+	20	8
+</BUCKETS>
+<TTLBUCKETS>
+	63	1
+	64	98
+</TTLBUCKETS>
+<NREORDERING>
+	1	2
+</NREORDERING>
+NEW_KEY	1
+<NEWSECTION>
+	1	2	3
+	4	5	6
+</NEWSECTION>
+`
+
+func TestParseSummary(t *testing.T) {
+	got, err := ParseSummary(bufio.NewReader(strings.NewReader(testSummary)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := SummaryReport{
+		summaryVersion:   "3.0",
+		sid:              "C0000201E0F1A2B3C4D5E6F701234567",
+		fromHost:         "sender example",
+		fromAddr:         "192.0.2.1",
+		fromPort:         "9000",
+		toHost:           "receiver",
+		toAddr:           "192.0.2.2",
+		toPort:           "9001",
+		startTime:        0xE0F1A2B300000000,
+		endTime:          0xE0F1A2BD00000000,
+		dscp:             46,
+		lossTimeout:      10 << 32,
+		packetPadding:    14,
+		sessionPkts:      100,
+		samplePkts:       100,
+		finished:         true,
+		sync:             true,
+		sentPkts:         100,
+		dupPkts:          1,
+		lostPkts:         2,
+		maxErr:           0.0001,
+		latencyMin:       0.001,
+		latencyMed:       0.002,
+		latencyMax:       0.003,
+		latencyPDV:       0.0005,
+		ttlMin:           63,
+		ttlMax:           64,
+		latencyHistWidth: 0.0001,
+		latencyHist:      []HistogramEntry{{-1, 1}, {10, 90}, {20, 8}},
+		ttlHist:          []HistogramEntry{{63, 1}, {64, 98}},
+		reorderingHist:   []HistogramEntry{{1, 2}},
+		sections: map[string][]SummarySectionRow{
+			"newsection": {{"1", []float64{2, 3}}, {"4", []float64{5, 6}}},
+		},
+		// NEW_KEY
+		unknownKeys: 1,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parsed summary differs\n got: %+v\nwant: %+v", got, want)
+	}
+
+	negative, total := got.negativeLatencyPackets()
+	if negative != 1 || total != 99 {
+		t.Errorf("negativeLatencyPackets() = %d, %d, want 1, 99", negative, total)
+	}
+}
+
+func TestParseSummaryUnixTimeFallback(t *testing.T) {
+	input := "SUMMARY\t3.0\nUNIX_START_TIME\t1563845224.5\nUNIX_END_TIME\t1563845234.25\n"
+	got, err := ParseSummary(bufio.NewReader(strings.NewReader(input)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := OWTimestampFromUnix(1563845224.5); got.startTime != want {
+		t.Errorf("startTime = %X, want %X", uint64(got.startTime), uint64(want))
+	}
+	if want := OWTimestampFromUnix(1563845234.25); got.endTime != want {
+		t.Errorf("endTime = %X, want %X", uint64(got.endTime), uint64(want))
+	}
+}
+
+func TestParseSummaryErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		reason string
+	}{
+		{"empty", "", summaryErrIncomplete},
+		{"missing version", "SENT\t100\n", summaryErrIncomplete},
+		{"version 2", "SUMMARY\t2.0\n", summaryErrUnsupportedVersion},
+		{"version 4", "SUMMARY_VERSION\t4.1\n", summaryErrUnsupportedVersion},
+		{"invalid start_time", "SUMMARY\t3.0\nSTART_TIME\tnow\n", summaryErrInvalidValue},
+		{"invalid unix_end_time", "SUMMARY\t3.0\nUNIX_END_TIME\tx\n", summaryErrInvalidValue},
+		{"invalid dscp", "SUMMARY\t3.0\nDSCP\t0x100\n", summaryErrInvalidValue},
+		{"invalid sent", "SUMMARY\t3.0\nSENT\t-1\n", summaryErrInvalidValue},
+		{"invalid sync", "SUMMARY\t3.0\nSYNC\tyes\n", summaryErrInvalidValue},
+		{"invalid min", "SUMMARY\t3.0\nMIN\tnan?\n", summaryErrInvalidValue},
+		{"invalid bucket_width", "SUMMARY\t3.0\nBUCKET_WIDTH\t\n", summaryErrInvalidValue},
+		{"histogram entry length", "SUMMARY\t3.0\n<BUCKETS>\n\t1\t2\t3\n</BUCKETS>\n", summaryErrInvalidSection},
+		{"histogram key", "SUMMARY\t3.0\n<BUCKETS>\n\tx\t2\n</BUCKETS>\n", summaryErrInvalidSection},
+		{"histogram value", "SUMMARY\t3.0\n<TTLBUCKETS>\n\t1\t-2\n</TTLBUCKETS>\n", summaryErrInvalidSection},
+		{"unterminated histogram", "SUMMARY\t3.0\n<NREORDERING>\n\t1\t2\n", summaryErrInvalidSection},
+		{"unterminated unknown section", "SUMMARY\t3.0\n<NEWSECTION>\n\t1\t2\t3\n", summaryErrInvalidSection},
+		{"section entry length", "SUMMARY\t3.0\n<NEWSECTION>\n\t1\n</NEWSECTION>\n", summaryErrInvalidSection},
+		{"section value", "SUMMARY\t3.0\n<NEWSECTION>\n\t1\t2\tx\n</NEWSECTION>\n", summaryErrInvalidSection},
+		{"duplicate section key", "SUMMARY\t3.0\n<NEWSECTION>\n\t1\t2\n\t1\t3\n</NEWSECTION>\n", summaryErrInvalidSection},
+	}
+
+	for _, tt := range tests {
+		_, err := ParseSummary(bufio.NewReader(strings.NewReader(tt.input)))
+		if err == nil {
+			t.Errorf("%s: expected error", tt.name)
+			continue
+		}
+		if reason := summaryErrorReason(err); reason != tt.reason {
+			t.Errorf("%s: reason = %q, want %q (%v)", tt.name, reason, tt.reason, err)
+		}
+	}
+}
+
+func TestParseHistogram(t *testing.T) {
+	// negative keys are written by owstats for packets received before they were sent
+	s := bufio.NewScanner(strings.NewReader("\t-12\t1\n\t-1\t2\n\t0\t3\n\t17\t4\n</BUCKETS>\nSENT\t10\n"))
+	got, err := ParseHistogram(s)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []HistogramEntry{{-12, 1}, {-1, 2}, {0, 3}, {17, 4}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// the scanner is left after the closing tag
+	if !s.Scan() || s.Text() != "SENT\t10" {
+		t.Errorf("scanner not positioned after the histogram")
+	}
+}
+
+func TestNegativeLatencyPackets(t *testing.T) {
+	tests := []struct {
+		hist     []HistogramEntry
+		negative uint64
+		total    uint64
+	}{
+		{nil, 0, 0},
+		{[]HistogramEntry{{0, 5}, {3, 5}}, 0, 10},
+		{[]HistogramEntry{{-3, 2}, {-1, 1}, {0, 4}, {9, 3}}, 3, 10},
+		{[]HistogramEntry{{-2, 7}}, 7, 7},
+	}
+	for _, tt := range tests {
+		s := SummaryReport{latencyHist: tt.hist}
+		negative, total := s.negativeLatencyPackets()
+		if negative != tt.negative || total != tt.total {
+			t.Errorf("%v: got %d of %d negative, want %d of %d", tt.hist, negative, total, tt.negative, tt.total)
+		}
+	}
+}
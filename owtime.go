@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// OWAMP timestamp as specified in RFC 4656 section 4.1.2
+// the upper 32bit are the seconds since the OWAMP/NTP epoch (1900-01-01)
+// and the lower 32bit the fractional part of the second
+type OWTimestamp uint64
+
+// seconds between the OWAMP epoch (1900-01-01) and the UNIX epoch
+const owpEpochOffset = 2208988800
+
+func OWTimestampFromTime(t time.Time) OWTimestamp {
+	secs := uint64(t.Unix() + owpEpochOffset)
+	// round to the nearest fraction
+	frac := (uint64(t.Nanosecond())<<32 + 500000000) / 1000000000
+	return OWTimestamp(secs<<32 + frac)
+}
+
+// convert a UNIX time in seconds (as printed by owstats -U) into an OWAMP timestamp
+func OWTimestampFromUnix(t float64) OWTimestamp {
+	secs, frac := math.Modf(t)
+	return OWTimestamp(uint64(int64(secs)+owpEpochOffset)<<32 + uint64(math.Round(frac*(1<<32))))
+}
+
+// parse the hexadecimal representation used by owstats for START_TIME/END_TIME
+func ParseOWTimestamp(s string) (OWTimestamp, error) {
+	t, err := strconv.ParseUint(s, 16, 64)
+	return OWTimestamp(t), err
+}
+
+func (t OWTimestamp) seconds() int64 {
+	return int64(t>>32) - owpEpochOffset
+}
+
+func (t OWTimestamp) nanoseconds() int64 {
+	return int64((uint64(t&0xffffffff)*1000000000 + 1<<31) >> 32)
+}
+
+func (t OWTimestamp) IsZero() bool {
+	return t == 0
+}
+
+func (t OWTimestamp) Time() time.Time {
+	return time.Unix(t.seconds(), t.nanoseconds())
+}
+
+// milliseconds UNIX time suitable as prometheus/openmetrics sample timestamp
+func (t OWTimestamp) UnixMilli() uint64 {
+	return uint64(t.Time().UnixMilli())
+}
+
+// UNIX time in seconds formatted with full nanosecond precision
+func (t OWTimestamp) FormatUnix() string {
+	tt := t.Time()
+	return fmt.Sprintf("%d.%09d", tt.Unix(), tt.Nanosecond())
+}
+
+// signed difference t-u in seconds
+func (t OWTimestamp) Sub(u OWTimestamp) float64 {
+	return float64(int64(t-u)) / (1 << 32)
+}
+
+// mid-point between two timestamps
+func (t OWTimestamp) Mid(u OWTimestamp) OWTimestamp {
+	if u < t {
+		return u + (t-u)/2
+	}
+	return t + (u-t)/2
+}
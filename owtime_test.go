@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOWTimestampRoundTrip(t *testing.T) {
+	tests := []time.Time{
+		time.Unix(0, 0),
+		time.Unix(1563845224, 1),
+		time.Unix(1563845224, 500000000),
+		time.Unix(1563845224, 999999999),
+		// shortly before the end of the first OWAMP era in 2036
+		time.Unix(2085978495, 123456789),
+	}
+	for _, tt := range tests {
+		ts := OWTimestampFromTime(tt)
+		// a fraction of 2^-32s is below a nanosecond, so the conversion back is exact
+		if got := ts.Time(); !got.Equal(tt) {
+			t.Errorf("%v converted back to %v", tt, got)
+		}
+		if got := OWTimestampFromTime(ts.Time()); got != ts {
+			t.Errorf("%X converted back to %X", uint64(ts), uint64(got))
+		}
+	}
+}
+
+func TestOWTimestampConversions(t *testing.T) {
+	// 2019-07-23 01:27:04.5 UTC
+	ts := OWTimestamp((1563845224+owpEpochOffset)<<32 | 1<<31)
+
+	if got := OWTimestampFromUnix(1563845224.5); got != ts {
+		t.Errorf("OWTimestampFromUnix() = %X, want %X", uint64(got), uint64(ts))
+	}
+	if got, err := ParseOWTimestamp("E0E0E0E880000000"); err != nil || got != ts {
+		t.Errorf("ParseOWTimestamp() = %X, %v, want %X", uint64(got), err, uint64(ts))
+	}
+	if got := ts.FormatUnix(); got != "1563845224.500000000" {
+		t.Errorf("FormatUnix() = %s", got)
+	}
+	if got := ts.UnixMilli(); got != 1563845224500 {
+		t.Errorf("UnixMilli() = %d", got)
+	}
+
+	// the difference keeps the sign and the fraction
+	later := ts + 3<<32 + 1<<30
+	if d := later.Sub(ts); d != 3.25 {
+		t.Errorf("later.Sub() = %v, want 3.25", d)
+	}
+	if d := ts.Sub(later); d != -3.25 {
+		t.Errorf("earlier.Sub() = %v, want -3.25", d)
+	}
+	if mid := ts.Mid(later); mid != ts+(3<<32+1<<30)/2 || later.Mid(ts) != mid {
+		t.Errorf("Mid() = %X", uint64(mid))
+	}
+	if !OWTimestamp(0).IsZero() || ts.IsZero() {
+		t.Error("IsZero() wrong")
+	}
+}
@@ -1,26 +1,50 @@
 package main
 
 import (
-	"bufio"
-	"fmt"
-	"io"
-	"strings"
+	"context"
+	"strconv"
 	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 type Registry struct {
 	reports           map[uint]MeasurementReport
+	sessions          map[uint]SessionStats
 	inChannel         chan MeasurementReport
 	cfg               Config
 	mutex             sync.Mutex
 	victoriaHistogram bool
+	responder         *OWAMPServer
+	reflector         *STAMPReflector
+
+	// cancel functions of the running measurement workers
+	ctx         context.Context
+	nextIdx     uint
+	workers     map[uint]context.CancelFunc
+	statuses    map[uint]*WorkerStatus
+	parseErrors map[uint]map[string]uint64
+	totals      map[uint]*MeasurementTotals
+	histories   map[uint]*MeasurementHistory
+	wg          sync.WaitGroup
+	reloadStats ReloadStats
+
+	shutdownHooks []func() error
 }
 
 func NewRegistry(cfg Config) *Registry {
 	reg := &Registry{
-		reports:   make(map[uint]MeasurementReport),
-		inChannel: make(chan MeasurementReport),
-		cfg:       cfg,
+		reports:     make(map[uint]MeasurementReport),
+		sessions:    make(map[uint]SessionStats),
+		inChannel:   make(chan MeasurementReport),
+		workers:     make(map[uint]context.CancelFunc),
+		statuses:    make(map[uint]*WorkerStatus),
+		parseErrors: make(map[uint]map[string]uint64),
+		totals:      make(map[uint]*MeasurementTotals),
+		histories:   make(map[uint]*MeasurementHistory),
+		cfg:         cfg,
+		nextIdx:     uint(len(cfg.measurements)),
 	}
 	go reg.runCollector()
 	return reg
@@ -29,106 +53,273 @@ func NewRegistry(cfg Config) *Registry {
 func (r *Registry) runCollector() {
 	for {
 		report := <-r.inChannel
+		// a report may carry the summary, the per-packet data or both
+		var stats SessionStats
+		if report.session != nil {
+			stats = AnalyzeSession(report.session)
+		}
 		r.mutex.Lock()
-		r.reports[report.measurementIdx] = report
+		// drop late reports of stopped measurements
+		if _, running := r.workers[report.measurementIdx]; !running {
+			r.mutex.Unlock()
+			continue
+		}
+		if report.parseError != "" {
+			if r.parseErrors[report.measurementIdx] == nil {
+				r.parseErrors[report.measurementIdx] = make(map[string]uint64)
+			}
+			r.parseErrors[report.measurementIdx][report.parseError]++
+		}
+		if report.summary != nil {
+			// a session discovered late must not replace the report of a newer one
+			if cur, found := r.reports[report.measurementIdx]; !found || report.summary.startTime >= cur.summary.startTime {
+				r.reports[report.measurementIdx] = report
+			}
+			if r.totals[report.measurementIdx] == nil {
+				r.totals[report.measurementIdx] = NewMeasurementTotals()
+			}
+			r.totals[report.measurementIdx].merge(report.summary)
+			r.addToHistory(report)
+		}
+		if report.session != nil {
+			if cur, found := r.sessions[report.measurementIdx]; !found || stats.timestamp >= cur.timestamp {
+				r.sessions[report.measurementIdx] = stats
+			}
+		}
 		r.mutex.Unlock()
 	}
 }
 
-func (r *Registry) DumpMetrics(w io.Writer) error {
+// the metrics depend on the configuration, so no descriptors are sent and the collector is unchecked
+func (r *Registry) Describe(ch chan<- *prometheus.Desc) {
+}
+
+func (r *Registry) Collect(ch chan<- prometheus.Metric) {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
+	me := metricEmitter{ch: ch}
 
-	bw := bufio.NewWriterSize(w, 512*1024)
-	defer bw.Flush()
+	now := time.Now()
+	for mIdx := range r.cfg.measurements {
+		r.writeSessionAge(me, uint(mIdx), now)
+	}
 
 	for mIdx, report := range r.reports {
+		if r.isStale(mIdx, now) {
+			continue
+		}
 		mcfg := r.cfg.measurements[mIdx]
-		tags := strings.Join(mcfg.tags, ",")
-		ts := uint64(report.metricsTimestamp * 1000.0)
+		labels := prometheus.Labels(mcfg.labels)
+		ts := report.metricsTimestamp.Time()
 		rs := report.summary
 
-		var err error
-
 		// write run meta-data
-		_, err = fmt.Fprintf(bw, "owamp_start_time{%s} %.3f %d\n", tags, rs.startTime, ts)
-		if err != nil {
-			return err
-		}
-		_, err = fmt.Fprintf(bw, "owamp_end_time{%s} %.3f %d\n", tags, rs.endTime, ts)
-		if err != nil {
-			return err
-		}
+		me.addAt("owamp_start_time", labels, float64(rs.startTime.Time().UnixNano())/1e9, ts)
+		me.addAt("owamp_end_time", labels, float64(rs.endTime.Time().UnixNano())/1e9, ts)
 
 		// write packet stats
-		_, err = fmt.Fprintf(bw, "owamp_packets_sent{%s} %d %d\n", tags, rs.sentPkts, ts)
-		if err != nil {
-			return err
-		}
-		_, err = fmt.Fprintf(bw, "owamp_packets_dup{%s} %d %d\n", tags, rs.dupPkts, ts)
-		if err != nil {
-			return err
-		}
-		_, err = fmt.Fprintf(bw, "owamp_packets_lost{%s} %d %d\n", tags, rs.lostPkts, ts)
-		if err != nil {
-			return err
-		}
+		me.addAt("owamp_session_packets_sent", labels, float64(rs.sentPkts), ts)
+		me.addAt("owamp_session_packets_dup", labels, float64(rs.dupPkts), ts)
+		me.addAt("owamp_session_packets_lost", labels, float64(rs.lostPkts), ts)
 
 		// write latency histogram
 		if r.victoriaHistogram {
-			err = WriteHistogramVictoriaMetrics(bw, "owamp_latency", tags, ts, rs.latencyHist, rs.latencyHistWidth)
-			if err != nil {
-				return err
-			}
+			WriteHistogramVictoriaMetrics(me, "owamp_latency", labels, ts, rs.latencyHist, rs.latencyHistWidth)
 
 			// write TTL histogram
-			err = WriteHistogramVictoriaMetrics(bw, "owamp_ttl", tags, ts, rs.ttlHist, 1.0)
-			if err != nil {
-				return err
-			}
+			WriteHistogramVictoriaMetrics(me, "owamp_ttl", labels, ts, rs.ttlHist, 1.0)
 
 			// write reordering histogram
-			err = WriteHistogramVictoriaMetrics(bw, "owamp_reordering", tags, ts, rs.reorderingHist, 1.0)
-			if err != nil {
-				return err
-			}
+			WriteHistogramVictoriaMetrics(me, "owamp_reordering", labels, ts, rs.reorderingHist, 1.0)
 		} else {
-			err = WriteHistogramPrometheus(bw, "owamp_latency", tags, ts, rs.latencyHist, rs.latencyHistWidth, mcfg.promHistBins)
-			if err != nil {
-				return err
-			}
+			WriteHistogramPrometheus(me, "owamp_latency", labels, ts, rs.latencyHist, rs.latencyHistWidth, mcfg.promHistBins)
 
-			// TODO: write TTL histogram
-			// err = WriteHistogramPrometheus(bw, "owamp_ttl", tags, ts, rs.ttlHist, 1.0)
-			// if err != nil {
-			// 	return err
-			// }
-
-			// TODO: write reordering histogram
-			// err = WriteHistogramPrometheus(bw, "owamp_reordering", tags, ts, rs.reorderingHist, 1.0)
-			// if err != nil {
-			// 	return err
-			// }
+			// write the TTL and reordering tables with one sample per row
+			for _, entry := range rs.ttlHist {
+				me.addAt("owamp_ttl_packets", labels, float64(entry.value), ts, "ttl", strconv.FormatInt(entry.key, 10))
+			}
+			for _, entry := range rs.reorderingHist {
+				me.addAt("owamp_reordering_packets", labels, float64(entry.value), ts, "n", strconv.FormatInt(entry.key, 10))
+			}
 		}
 
 		// write latency summary values
-		_, err = fmt.Fprintf(bw, "owamp_latency_min{%s} %e %d\n", tags, rs.latencyMin, ts)
-		if err != nil {
-			return err
+		me.addAt("owamp_latency_min", labels, rs.latencyMin, ts)
+		me.addAt("owamp_latency_median", labels, rs.latencyMed, ts)
+		me.addAt("owamp_latency_max", labels, rs.latencyMax, ts)
+
+		me.addAt("owamp_time_error_estimate", labels, rs.maxErr, ts)
+
+		// write two-way results
+		if report.twoWay != nil {
+			rt := report.twoWay.roundTrip
+			if r.victoriaHistogram {
+				WriteHistogramVictoriaMetrics(me, "owamp_twoway_latency", labels, ts, rt.latencyHist, rt.latencyHistWidth)
+			} else {
+				WriteHistogramPrometheus(me, "owamp_twoway_latency", labels, ts, rt.latencyHist, rt.latencyHistWidth, mcfg.promHistBins)
+			}
+			me.addAt("owamp_twoway_latency_min", labels, rt.latencyMin, ts)
+			me.addAt("owamp_twoway_latency_median", labels, rt.latencyMed, ts)
+			me.addAt("owamp_twoway_latency_max", labels, rt.latencyMax, ts)
+
+			rev := report.twoWay.reverse
+			me.addAt("owamp_reverse_latency_min", labels, rev.latencyMin, ts)
+			me.addAt("owamp_reverse_latency_median", labels, rev.latencyMed, ts)
+			me.addAt("owamp_reverse_latency_max", labels, rev.latencyMax, ts)
+
+			// write the information returned in the STAMP TLVs
+			if st := report.twoWay.stamp; st != nil {
+				me.addAt("owamp_stamp_tlv_packets", labels, float64(st.tlvPackets), ts)
+				me.addAt("owamp_stamp_tlv_unrecognized", labels, float64(st.unrecognized), ts)
+				me.addAt("owamp_stamp_tlv_malformed", labels, float64(st.malformed), ts)
+				me.addAt("owamp_stamp_reflector_sync_source", labels, float64(st.syncSourceIn), ts, "direction", "in")
+				me.addAt("owamp_stamp_reflector_sync_source", labels, float64(st.syncSourceOut), ts, "direction", "out")
+				me.addAt("owamp_stamp_reflector_timestamp_method", labels, float64(st.timestampMethIn), ts, "direction", "in")
+				me.addAt("owamp_stamp_reflector_timestamp_method", labels, float64(st.timestampMethOut), ts, "direction", "out")
+			}
 		}
-		_, err = fmt.Fprintf(bw, "owamp_latency_median{%s} %e %d\n", tags, rs.latencyMed, ts)
-		if err != nil {
-			return err
+
+		// write session information
+		me.addAt("owamp_session_info", labels, 1, ts, "summary_version", rs.summaryVersion, "from_addr", rs.fromAddr, "to_addr", rs.toAddr)
+		me.addAt("owamp_clock_sync", labels, float64(boolToInt(rs.sync)), ts)
+		me.addAt("owamp_session_finished", labels, float64(boolToInt(rs.finished)), ts)
+		me.addAt("owamp_session_packets", labels, float64(rs.sessionPkts), ts)
+		me.addAt("owamp_sample_packets", labels, float64(rs.samplePkts), ts)
+		me.addAt("owamp_packets_errors", labels, float64(rs.errorPkts), ts)
+		me.addAt("owamp_dscp", labels, float64(rs.dscp), ts)
+		me.addAt("owamp_packet_padding_bytes", labels, float64(rs.packetPadding), ts)
+		me.addAt("owamp_loss_timeout_seconds", labels, float64(rs.lossTimeout)/(1<<32), ts)
+
+		// write additional summary values
+		me.addAt("owamp_latency_pdv", labels, rs.latencyPDV, ts)
+		me.addAt("owamp_ttl_min", labels, float64(rs.ttlMin), ts)
+		me.addAt("owamp_ttl_max", labels, float64(rs.ttlMax), ts)
+		me.addAt("owamp_summary_unknown_keys", labels, float64(rs.unknownKeys), ts)
+
+		// write the tables of the sections without dedicated metrics, one sample per value column
+		for name, rows := range rs.sections {
+			for _, row := range rows {
+				for i, value := range row.values {
+					me.addAt("owamp_summary_section_value", labels, value, ts, "section", name, "key", row.key, "column", strconv.Itoa(i+1))
+				}
+			}
+		}
+
+		// write clock-skew indicators
+		negPkts, totalPkts := rs.negativeLatencyPackets()
+		negRatio := 0.0
+		if totalPkts > 0 {
+			negRatio = float64(negPkts) / float64(totalPkts)
 		}
-		_, err = fmt.Fprintf(bw, "owamp_latency_max{%s} %e %d\n", tags, rs.latencyMax, ts)
-		if err != nil {
-			return err
+		me.addAt("owamp_latency_negative_packets", labels, float64(negPkts), ts)
+		me.addAt("owamp_latency_negative_ratio", labels, negRatio, ts)
+	}
+
+	// metrics derived from the per-packet data
+	for mIdx, stats := range r.sessions {
+		if r.isStale(mIdx, now) {
+			continue
+		}
+		mcfg := r.cfg.measurements[mIdx]
+		labels := prometheus.Labels(mcfg.labels)
+		ts := stats.timestamp.Time()
+		dv := stats.delayVariation
+
+		// write delay variation values
+		me.addAt("owamp_ipdv_mean", labels, dv.ipdvMean, ts)
+		me.addAt("owamp_ipdv_p95", labels, dv.ipdvP95, ts)
+		me.addAt("owamp_ipdv_p99", labels, dv.ipdvP99, ts)
+		me.addAt("owamp_pdv_mean", labels, dv.pdvMean, ts)
+		me.addAt("owamp_pdv_p95", labels, dv.pdvP95, ts)
+		me.addAt("owamp_pdv_p99", labels, dv.pdvP99, ts)
+
+		// write loss episode statistics
+		lp := stats.lossPattern
+		me.addAt("owamp_loss_episodes", labels, float64(lp.episodes), ts)
+		me.addAt("owamp_loss_burst_length_mean", labels, lp.burstMean, ts)
+		me.addAt("owamp_loss_burst_length_max", labels, float64(lp.burstMax), ts)
+		if r.victoriaHistogram {
+			WriteHistogramVictoriaMetrics(me, "owamp_loss_run_length", labels, ts, lp.runLengths, 1.0)
+		} else {
+			WriteHistogramPrometheus(me, "owamp_loss_run_length", labels, ts, lp.runLengths, 1.0, lossRunHistBins)
+		}
+	}
+	// write the summary parse errors
+	for mIdx, reasons := range r.parseErrors {
+		labels := prometheus.Labels(r.cfg.measurements[mIdx].labels)
+		for reason, count := range reasons {
+			me.add("owamp_summary_parse_errors_total", labels, float64(count), "reason", reason)
+		}
+	}
+	// write the counters accumulated over all sessions
+	for mIdx, totals := range r.totals {
+		r.writeTotals(me, mIdx, totals)
+	}
+	// write the aggregates of the sliding windows
+	for mIdx, history := range r.histories {
+		if r.isStale(mIdx, now) {
+			continue
 		}
+		r.writeWindows(me, mIdx, history, now)
+	}
+	// write status of the supervised measurement processes
+	for mIdx, status := range r.statuses {
+		labels := prometheus.Labels(r.cfg.measurements[mIdx].labels)
+		status.WriteMetrics(me, labels)
+	}
+	// write statistics of the built-in OWAMP server
+	if r.responder != nil {
+		r.responder.WriteMetrics(me)
+	}
+	// write statistics of the built-in STAMP reflector
+	if r.reflector != nil {
+		r.reflector.WriteMetrics(me)
+	}
+	r.writeReloadMetrics(me)
+}
 
-		_, err = fmt.Fprintf(bw, "owamp_time_error_estimate{%s} %e %d\n", tags, rs.maxErr, ts)
-		if err != nil {
-			return err
+// time of the last session of a measurement (end of the last summary or start of the last per-packet data)
+func (r *Registry) lastSessionTime(mIdx uint) (time.Time, bool) {
+	var last time.Time
+	if report, found := r.reports[mIdx]; found {
+		last = report.summary.endTime.Time()
+		if report.summary.endTime.IsZero() {
+			last = report.metricsTimestamp.Time()
 		}
 	}
-	return nil
+	if stats, found := r.sessions[mIdx]; found && stats.timestamp.Time().After(last) {
+		last = stats.timestamp.Time()
+	}
+	return last, !last.IsZero()
+}
+
+// whether the last session of a measurement is older than the staleness limit
+func (r *Registry) isStale(mIdx uint, now time.Time) bool {
+	if r.cfg.staleAfter == 0 {
+		return false
+	}
+	last, found := r.lastSessionTime(mIdx)
+	return found && now.Sub(last) > r.cfg.staleAfter
+}
+
+// write the age of the last session and whether the measurement is up (not stale)
+func (r *Registry) writeSessionAge(me metricEmitter, mIdx uint, now time.Time) {
+	last, found := r.lastSessionTime(mIdx)
+	if !found {
+		return
+	}
+	labels := prometheus.Labels(r.cfg.measurements[mIdx].labels)
+	me.add("owamp_last_session_age_seconds", labels, now.Sub(last).Seconds())
+	stale := r.isStale(mIdx, now)
+	if stale && r.cfg.staleMode == "omit" {
+		return
+	}
+	me.add("owamp_up", labels, float64(boolToInt(!stale)))
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
 }
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+// configuration reload with minimal worker churn
+//
+// Measurements are matched between the old and the new configuration by
+// their complete settings. Unchanged measurements keep their worker, index
+// and last reports; removed or changed ones are stopped and new ones are
+// started at fresh indices (indices are never reused, so late reports of a
+// stopped worker can not be mistaken for those of a new one). The settings of
+// removed measurements are dropped from the configuration.
+// The responder and reflector settings are only applied on restart.
+
+type ReloadStats struct {
+	reloads        uint64
+	reloadFailures uint64
+	lastSuccessful uint64
+}
+
+// key identifying a measurement across configuration reloads
+func measurementKey(cfg Config, mcfg MeasurementCfg) string {
+	return fmt.Sprintf("%+v %+v %+v %d-%d %s %s %s",
+		mcfg, cfg.targets[mcfg.targetSrc], cfg.targets[mcfg.targetDst],
+		cfg.portRangeMin, cfg.portRangeMax, cfg.baseWorkDir, cfg.powstreamCmd, cfg.owpingCmd)
+}
+
+// start the workers of all configured measurements
+func (r *Registry) StartMeasurements(ctx context.Context) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.ctx = ctx
+	atomic.StoreUint64(&r.reloadStats.lastSuccessful, 1)
+	for idx := uint(0); idx < uint(len(r.cfg.measurements)); idx++ {
+		r.startMeasurement(idx)
+	}
+}
+
+// start the worker of a single measurement, the mutex has to be held
+func (r *Registry) startMeasurement(idx uint) {
+	w, err := NewMeasurementBackend(r.cfg, idx, r.inChannel)
+	if err != nil {
+		log.Printf("%d failed to create measurement backend: %v", idx, err)
+		return
+	}
+	if sb, ok := w.(supervisedBackend); ok {
+		r.statuses[idx] = sb.Status()
+	}
+	ctx, cancel := context.WithCancel(r.ctx)
+	r.workers[idx] = cancel
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		w.RunWorker(ctx)
+	}()
+}
+
+// stop the worker of a single measurement and drop its reports, the mutex has to be held
+func (r *Registry) stopMeasurement(idx uint) {
+	r.workers[idx]()
+	delete(r.workers, idx)
+	delete(r.statuses, idx)
+	delete(r.parseErrors, idx)
+	delete(r.reports, idx)
+	delete(r.sessions, idx)
+	delete(r.totals, idx)
+	delete(r.histories, idx)
+}
+
+// load a new configuration and apply it, keeping the old one on failure
+func (r *Registry) Reload(load func() (Config, error)) error {
+	atomic.AddUint64(&r.reloadStats.reloads, 1)
+	cfg, err := load()
+	if err != nil {
+		atomic.AddUint64(&r.reloadStats.reloadFailures, 1)
+		atomic.StoreUint64(&r.reloadStats.lastSuccessful, 0)
+		return err
+	}
+	r.applyConfig(cfg)
+	atomic.StoreUint64(&r.reloadStats.lastSuccessful, 1)
+	return nil
+}
+
+func (r *Registry) applyConfig(cfg Config) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// running measurements by their key
+	running := make(map[string]uint)
+	for idx := range r.workers {
+		running[measurementKey(r.cfg, r.cfg.measurements[idx])] = idx
+	}
+
+	// only the kept and new measurements remain in the configuration, so removed ones are released
+	measurements := make(map[uint]MeasurementCfg, len(cfg.measurements))
+	keep := make(map[uint]bool)
+	start := make([]uint, 0)
+	for i := uint(0); i < uint(len(cfg.measurements)); i++ {
+		mcfg := cfg.measurements[i]
+		key := measurementKey(cfg, mcfg)
+		if idx, found := running[key]; found {
+			delete(running, key)
+			keep[idx] = true
+			measurements[idx] = r.cfg.measurements[idx]
+			continue
+		}
+		start = append(start, r.nextIdx)
+		measurements[r.nextIdx] = mcfg
+		r.nextIdx++
+	}
+
+	for idx := range r.workers {
+		if !keep[idx] {
+			log.Printf("%d stopping removed or changed measurement", idx)
+			r.stopMeasurement(idx)
+		}
+	}
+
+	cfg.measurements = measurements
+	r.cfg = cfg
+	for _, idx := range start {
+		log.Printf("%d starting new measurement", idx)
+		r.startMeasurement(idx)
+	}
+	log.Printf("configuration reloaded: %d measurements kept, %d started", len(keep), len(start))
+}
+
+func (r *Registry) writeReloadMetrics(me metricEmitter) {
+	stats := []struct {
+		name  string
+		value uint64
+	}{
+		{"owamp_config_reloads_total", atomic.LoadUint64(&r.reloadStats.reloads)},
+		{"owamp_config_reload_failures_total", atomic.LoadUint64(&r.reloadStats.reloadFailures)},
+		{"owamp_config_last_reload_successful", atomic.LoadUint64(&r.reloadStats.lastSuccessful)},
+	}
+	for _, stat := range stats {
+		me.add(stat.name, nil, float64(stat.value))
+	}
+}
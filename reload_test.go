@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// backend which only records which measurements are running
+type testBackend struct {
+	idx     uint
+	running *sync.Map
+}
+
+func (b *testBackend) RunWorker(ctx context.Context) {
+	b.running.Store(b.idx, true)
+	<-ctx.Done()
+	b.running.Delete(b.idx)
+}
+
+func testReloadConfig(ppss ...uint64) Config {
+	cfg := Config{
+		targets: map[string]TargetCfg{
+			"src": {hostname: "127.0.0.1", local: true},
+			"dst": {hostname: "192.0.2.1"},
+		},
+		measurements: make(map[uint]MeasurementCfg),
+	}
+	for i, pps := range ppss {
+		cfg.measurements[uint(i)] = MeasurementCfg{targetSrc: "src", targetDst: "dst", pps: pps, backend: "test"}
+	}
+	return cfg
+}
+
+func runningMeasurements(r *Registry) []uint {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	ret := make([]uint, 0, len(r.workers))
+	for idx := range r.workers {
+		ret = append(ret, idx)
+	}
+	sort.Slice(ret, func(i int, j int) bool {
+		return ret[i] < ret[j]
+	})
+	return ret
+}
+
+// wait until the workers of the given measurements are running or have returned
+func waitTestWorkers(t *testing.T, running *sync.Map, indices []uint, want bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for _, idx := range indices {
+		for _, found := running.Load(idx); found != want; _, found = running.Load(idx) {
+			if time.Now().After(deadline) {
+				t.Fatalf("worker of measurement %d running: %v, want %v", idx, found, want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestRegistryReload(t *testing.T) {
+	running := &sync.Map{}
+	RegisterMeasurementBackend("test", func(cfg Config, idx uint, outCh chan MeasurementReport) MeasurementBackend {
+		return &testBackend{idx: idx, running: running}
+	})
+	defer delete(measurementBackends, "test")
+
+	r := NewRegistry(testReloadConfig(1, 2, 3))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r.StartMeasurements(ctx)
+	waitTestWorkers(t, running, []uint{0, 1, 2}, true)
+	r.totals[1] = NewMeasurementTotals()
+
+	// 2 is kept, 1 and 3 are changed or removed, 4 is new
+	if err := r.Reload(func() (Config, error) { return testReloadConfig(2, 4, 5), nil }); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := runningMeasurements(r), []uint{1, 3, 4}; !reflect.DeepEqual(got, want) {
+		t.Errorf("running measurements %v, want %v", got, want)
+	}
+	if got := r.cfg.measurements[1].pps; got != 2 {
+		t.Errorf("kept measurement has pps %v, want 2", got)
+	}
+	if _, found := r.cfg.measurements[0]; found {
+		t.Error("settings of the removed measurement are still configured")
+	}
+	if r.totals[1] == nil {
+		t.Error("counters of the kept measurement were dropped")
+	}
+	// the workers of the stopped measurements return after their context is cancelled
+	waitTestWorkers(t, running, []uint{0, 2}, false)
+	waitTestWorkers(t, running, []uint{1, 3, 4}, true)
+
+	// a failed load keeps the running configuration
+	if err := r.Reload(func() (Config, error) { return Config{}, errors.New("invalid") }); err == nil {
+		t.Error("failed reload reported as successful")
+	}
+	if got, want := runningMeasurements(r), []uint{1, 3, 4}; !reflect.DeepEqual(got, want) {
+		t.Errorf("running measurements %v after failed reload, want %v", got, want)
+	}
+	if r.reloadStats.reloads != 2 || r.reloadStats.reloadFailures != 1 || r.reloadStats.lastSuccessful != 0 {
+		t.Errorf("unexpected reload stats %+v", r.reloadStats)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// measurement backend replaying previously recorded .sum and .owp files
+//
+// The files of the replay directory are fed to the registry in the order of
+// their names, one file every measurement duration, starting over at the end.
+
+type ReplayWorker struct {
+	measurementOut chan MeasurementReport
+	measurementIdx uint
+	mcfg           MeasurementCfg
+}
+
+func NewReplayWorker(cfg Config, idx uint, outCh chan MeasurementReport) *ReplayWorker {
+	return &ReplayWorker{
+		measurementOut: outCh,
+		measurementIdx: idx,
+		mcfg:           cfg.measurements[idx],
+	}
+}
+
+func (w *ReplayWorker) RunWorker(ctx context.Context) {
+	interval := time.Duration(w.mcfg.duration) * time.Second
+	for {
+		entries, err := os.ReadDir(w.mcfg.replayDir)
+		if err != nil {
+			log.Printf("%d failed reading replay directory: %v", w.measurementIdx, err)
+			return
+		}
+		names := make([]string, 0, len(entries))
+		for _, entry := range entries {
+			if strings.HasSuffix(entry.Name(), ".sum") || strings.HasSuffix(entry.Name(), ".owp") {
+				names = append(names, entry.Name())
+			}
+		}
+		if len(names) == 0 {
+			log.Printf("%d no .sum or .owp files to replay in %s", w.measurementIdx, w.mcfg.replayDir)
+			return
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			path := filepath.Join(w.mcfg.replayDir, name)
+			if strings.HasSuffix(name, ".sum") {
+				ParseSummaryFile(w.measurementOut, w.measurementIdx, path)
+			} else {
+				ParseDataFile(w.measurementOut, w.measurementIdx, path)
+			}
+			if !sleepContext(ctx, interval) {
+				return
+			}
+		}
+	}
+}
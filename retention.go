@@ -0,0 +1,217 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// retention of the session files (.sum and .owp) written by powstream
+//
+// Once a file was parsed successfully it is either deleted, compressed or
+// moved to the archive directory. The limits on the number of sessions, their
+// age and the total size are enforced on the directory the parsed files end up
+// in, removing the oldest sessions first.
+
+type RetentionCfg struct {
+	deleteAfterParse bool
+	compress         bool
+	archiveDir       string
+	// limits, 0 means unlimited
+	keepSessions uint64
+	maxAge       time.Duration
+	maxBytes     uint64
+}
+
+type retainedFile struct {
+	path    string
+	session string
+	size    uint64
+	modTime time.Time
+}
+
+type workDirRetention struct {
+	cfg        RetentionCfg
+	workDir    string
+	archiveDir string
+	status     *WorkerStatus
+	mutex      sync.Mutex
+}
+
+func newWorkDirRetention(cfg RetentionCfg, workDir string, archiveDir string, status *WorkerStatus) *workDirRetention {
+	return &workDirRetention{
+		cfg:        cfg,
+		workDir:    workDir,
+		archiveDir: archiveDir,
+		status:     status,
+	}
+}
+
+// session files managed by the retention, possibly compressed
+func isSessionFile(name string) bool {
+	name = strings.TrimSuffix(name, ".gz")
+	return strings.HasSuffix(name, ".sum") || strings.HasSuffix(name, ".owp")
+}
+
+// name of the session a file belongs to (the file name without its extensions)
+func sessionName(name string) string {
+	name = strings.TrimSuffix(name, ".gz")
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+// enforce the limits on the files already present
+func (r *workDirRetention) refresh() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.enforce()
+}
+
+// handle a successfully parsed file and enforce the limits
+func (r *workDirRetention) done(path string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var err error
+	if r.cfg.deleteAfterParse {
+		err = os.Remove(path)
+	} else if r.cfg.compress {
+		err = compressFile(path, r.keptPath(path)+".gz")
+	} else if r.archiveDir != "" {
+		err = os.Rename(path, r.keptPath(path))
+	}
+	if err != nil {
+		log.Printf("failed retention of %s: %v", path, err)
+	}
+
+	r.enforce()
+}
+
+// location where a parsed file is kept
+func (r *workDirRetention) keptPath(path string) string {
+	if r.archiveDir != "" {
+		return filepath.Join(r.archiveDir, filepath.Base(path))
+	}
+	return path
+}
+
+func (r *workDirRetention) keptDir() string {
+	if r.archiveDir != "" {
+		return r.archiveDir
+	}
+	return r.workDir
+}
+
+// remove the oldest sessions exceeding the limits and update the usage metrics, the mutex has to be held
+func (r *workDirRetention) enforce() {
+	files, err := scanSessionFiles(r.keptDir())
+	if err != nil {
+		log.Printf("failed to scan %s: %v", r.keptDir(), err)
+		return
+	}
+
+	// group the files by session, the file names start with the session timestamps
+	sessions := make([]string, 0)
+	bySession := make(map[string][]retainedFile)
+	var totalBytes uint64
+	for _, f := range files {
+		if _, found := bySession[f.session]; !found {
+			sessions = append(sessions, f.session)
+		}
+		bySession[f.session] = append(bySession[f.session], f)
+		totalBytes += f.size
+	}
+	sort.Strings(sessions)
+
+	now := time.Now()
+	for i, session := range sessions {
+		remaining := uint64(len(sessions) - i)
+		expired := false
+		for _, f := range bySession[session] {
+			if r.cfg.maxAge > 0 && now.Sub(f.modTime) > r.cfg.maxAge {
+				expired = true
+			}
+		}
+		if !expired && (r.cfg.keepSessions == 0 || remaining <= r.cfg.keepSessions) && (r.cfg.maxBytes == 0 || totalBytes <= r.cfg.maxBytes) {
+			break
+		}
+		for _, f := range bySession[session] {
+			if err := os.Remove(f.path); err != nil {
+				log.Printf("failed to remove %s: %v", f.path, err)
+				continue
+			}
+			totalBytes -= f.size
+		}
+	}
+
+	r.updateUsage()
+}
+
+// update the file count and size metrics of the work and archive directory
+func (r *workDirRetention) updateUsage() {
+	files, err := scanSessionFiles(r.workDir)
+	if err == nil {
+		r.status.setDirUsage("work", files)
+	}
+	if r.archiveDir != "" {
+		files, err = scanSessionFiles(r.archiveDir)
+		if err == nil {
+			r.status.setDirUsage("archive", files)
+		}
+	}
+}
+
+func scanSessionFiles(dir string) ([]retainedFile, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]retainedFile, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !isSessionFile(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		ret = append(ret, retainedFile{
+			path:    filepath.Join(dir, entry.Name()),
+			session: sessionName(entry.Name()),
+			size:    uint64(info.Size()),
+			modTime: info.ModTime(),
+		})
+	}
+	return ret, nil
+}
+
+// gzip src into dst and remove src
+func compressFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err = io.Copy(zw, in); err == nil {
+		err = zw.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
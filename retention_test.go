@@ -0,0 +1,147 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// write a session file of the given size and age
+func writeTestSessionFile(t *testing.T, dir string, name string, size int, age time.Duration) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now().Add(-age)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func listTestDir(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ret := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		ret = append(ret, entry.Name())
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func TestSessionFileNames(t *testing.T) {
+	tests := []struct {
+		name    string
+		session bool
+		base    string
+	}{
+		{"1000_2000.sum", true, "1000_2000"},
+		{"1000_2000.owp", true, "1000_2000"},
+		{"1000_2000.owp.gz", true, "1000_2000"},
+		{"1000_2000.owp.i", false, "1000_2000.owp"},
+		{"powstream.log", false, "powstream"},
+	}
+	for _, tt := range tests {
+		if got := isSessionFile(tt.name); got != tt.session {
+			t.Errorf("isSessionFile(%q) = %v, want %v", tt.name, got, tt.session)
+		}
+		if got := sessionName(tt.name); got != tt.base {
+			t.Errorf("sessionName(%q) = %q, want %q", tt.name, got, tt.base)
+		}
+	}
+}
+
+func TestRetentionLimits(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  RetentionCfg
+		want []string
+	}{
+		{"unlimited", RetentionCfg{}, []string{"1_2.owp", "1_2.sum", "3_4.sum", "5_6.sum", "other.txt"}},
+		// the files of a session are removed together
+		{"keep sessions", RetentionCfg{keepSessions: 2}, []string{"3_4.sum", "5_6.sum", "other.txt"}},
+		{"max age", RetentionCfg{maxAge: 90 * time.Minute}, []string{"5_6.sum", "other.txt"}},
+		{"max bytes", RetentionCfg{maxBytes: 250}, []string{"3_4.sum", "5_6.sum", "other.txt"}},
+		{"max bytes below newest", RetentionCfg{maxBytes: 50}, []string{"other.txt"}},
+	}
+
+	for _, tt := range tests {
+		dir := t.TempDir()
+		writeTestSessionFile(t, dir, "1_2.sum", 100, 3*time.Hour)
+		writeTestSessionFile(t, dir, "1_2.owp", 100, 3*time.Hour)
+		writeTestSessionFile(t, dir, "3_4.sum", 100, 2*time.Hour)
+		writeTestSessionFile(t, dir, "5_6.sum", 100, time.Hour)
+		writeTestSessionFile(t, dir, "other.txt", 1000, 4*time.Hour)
+
+		status := NewWorkerStatus()
+		newWorkDirRetention(tt.cfg, dir, "", status).refresh()
+		if got := listTestDir(t, dir); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: kept %v, want %v", tt.name, got, tt.want)
+		}
+		if files := status.dirFiles["work"]; files != uint64(len(tt.want)-1) {
+			t.Errorf("%s: work dir usage %d files, want %d", tt.name, files, len(tt.want)-1)
+		}
+	}
+}
+
+func TestRetentionDone(t *testing.T) {
+	t.Run("delete", func(t *testing.T) {
+		dir := t.TempDir()
+		path := writeTestSessionFile(t, dir, "1_2.sum", 10, 0)
+		newWorkDirRetention(RetentionCfg{deleteAfterParse: true}, dir, "", NewWorkerStatus()).done(path)
+		if got := listTestDir(t, dir); len(got) != 0 {
+			t.Errorf("files left: %v", got)
+		}
+	})
+
+	t.Run("archive", func(t *testing.T) {
+		dir, archiveDir := t.TempDir(), t.TempDir()
+		path := writeTestSessionFile(t, dir, "1_2.sum", 10, 0)
+		status := NewWorkerStatus()
+		newWorkDirRetention(RetentionCfg{keepSessions: 1}, dir, archiveDir, status).done(path)
+		if got := listTestDir(t, dir); len(got) != 0 {
+			t.Errorf("files left in the work dir: %v", got)
+		}
+		if got, want := listTestDir(t, archiveDir), []string{"1_2.sum"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("archived %v, want %v", got, want)
+		}
+		if status.dirFiles["archive"] != 1 || status.dirBytes["archive"] != 10 {
+			t.Errorf("archive usage %d files, %d bytes, want 1, 10", status.dirFiles["archive"], status.dirBytes["archive"])
+		}
+	})
+
+	t.Run("compress", func(t *testing.T) {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "1_2.sum")
+		if err := os.WriteFile(path, []byte(testSummary), 0644); err != nil {
+			t.Fatal(err)
+		}
+		newWorkDirRetention(RetentionCfg{compress: true}, dir, "", NewWorkerStatus()).done(path)
+		if got, want := listTestDir(t, dir), []string{"1_2.sum.gz"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("kept %v, want %v", got, want)
+		}
+
+		f, err := os.Open(path + ".gz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data, err := io.ReadAll(zr); err != nil || string(data) != testSummary {
+			t.Errorf("decompressed file differs (%v)", err)
+		}
+	})
+}
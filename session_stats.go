@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+)
+
+// metrics derived from the per-packet records of a session
+
+type SessionStats struct {
+	timestamp OWTimestamp
+
+	delayVariation DelayVariation
+	lossPattern    LossPattern
+}
+
+// delay variation of a session in seconds
+//
+// IPDV follows RFC 3393 with the selection function picking consecutive packets,
+// the statistics are computed over the absolute values of the IPDV samples.
+// PDV follows RFC 5481 and uses the minimum delay of the session as reference.
+type DelayVariation struct {
+	ipdvMean float64
+	ipdvP95  float64
+	ipdvP99  float64
+
+	pdvMean float64
+	pdvP95  float64
+	pdvP99  float64
+}
+
+func AnalyzeSession(session *OWPSession) SessionStats {
+	records := sortedRecords(session.records)
+
+	return SessionStats{
+		timestamp:      session.startTime,
+		delayVariation: ComputeDelayVariation(records),
+		lossPattern:    ComputeLossPattern(records),
+	}
+}
+
+// return a copy of the records sorted by sequence number with duplicates removed
+func sortedRecords(records []OWPRecord) []OWPRecord {
+	ret := make([]OWPRecord, len(records))
+	_ = copy(ret, records)
+	sort.SliceStable(ret, func(i int, j int) bool {
+		return ret[i].seqNo < ret[j].seqNo
+	})
+
+	n := 0
+	for i := range ret {
+		if n > 0 && ret[n-1].seqNo == ret[i].seqNo {
+			// prefer the first received copy over a lost record
+			if ret[n-1].lost() {
+				ret[n-1] = ret[i]
+			}
+			continue
+		}
+		ret[n] = ret[i]
+		n++
+	}
+	return ret[:n]
+}
+
+// nearest-rank quantile of an already sorted slice
+func quantile(sorted []float64, q float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(q*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
+
+func mean(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
+
+// compute IPDV and PDV from records sorted by sequence number
+func ComputeDelayVariation(records []OWPRecord) DelayVariation {
+	ret := DelayVariation{}
+
+	ipdv := make([]float64, 0, len(records))
+	pdv := make([]float64, 0, len(records))
+
+	minDelay := math.Inf(1)
+	for i := range records {
+		rec := &records[i]
+		if rec.lost() {
+			continue
+		}
+		delay := rec.delay()
+		pdv = append(pdv, delay)
+		if delay < minDelay {
+			minDelay = delay
+		}
+
+		// IPDV is only defined for pairs of consecutive packets which both arrived
+		if i > 0 && records[i-1].seqNo+1 == rec.seqNo && !records[i-1].lost() {
+			ipdv = append(ipdv, math.Abs(delay-records[i-1].delay()))
+		}
+	}
+
+	for i := range pdv {
+		pdv[i] -= minDelay
+	}
+
+	sort.Float64s(ipdv)
+	sort.Float64s(pdv)
+
+	ret.ipdvMean = mean(ipdv)
+	ret.ipdvP95 = quantile(ipdv, 0.95)
+	ret.ipdvP99 = quantile(ipdv, 0.99)
+	ret.pdvMean = mean(pdv)
+	ret.pdvP95 = quantile(pdv, 0.95)
+	ret.pdvP99 = quantile(pdv, 0.99)
+
+	return ret
+}
+
+// loss episodes of a session in the spirit of RFC 3357
+//
+// A loss episode is a run of consecutive lost packets, its length is the
+// number of packets lost in a row.
+type LossPattern struct {
+	episodes  uint64
+	burstMean float64
+	burstMax  uint64
+
+	// histogram of the loss run lengths
+	runLengths []HistogramEntry
+}
+
+// bins of the prometheus histogram of loss run lengths
+// (last bin is emitted as +Inf)
+var lossRunHistBins = []float64{1, 2, 3, 4, 5, 10, 20, 50, 100, 500, 1000}
+
+// compute the loss episodes from records sorted by sequence number
+func ComputeLossPattern(records []OWPRecord) LossPattern {
+	ret := LossPattern{}
+
+	runs := make(map[int64]uint64)
+	var lostTotal uint64 = 0
+	var runLength uint64 = 0
+	endRun := func() {
+		if runLength == 0 {
+			return
+		}
+		ret.episodes++
+		lostTotal += runLength
+		runs[int64(runLength)]++
+		if runLength > ret.burstMax {
+			ret.burstMax = runLength
+		}
+		runLength = 0
+	}
+
+	for i := range records {
+		// gaps in the sequence numbers (skipped packets) also end an episode
+		if i > 0 && records[i-1].seqNo+1 != records[i].seqNo {
+			endRun()
+		}
+		if records[i].lost() {
+			runLength++
+		} else {
+			endRun()
+		}
+	}
+	endRun()
+
+	if ret.episodes > 0 {
+		ret.burstMean = float64(lostTotal) / float64(ret.episodes)
+	}
+
+	ret.runLengths = histogramEntries(runs)
+
+	return ret
+}
+
+// build a summary report equivalent to the one of owstats from the per-packet data of a session
+func SummarizeSession(session *OWPSession, bucketWidth float64) SummaryReport {
+	records := sortedRecords(session.records)
+
+	ret := SummaryReport{
+		fromAddr:         ipString(session.senderAddr),
+		fromPort:         strconv.Itoa(int(session.senderPort)),
+		toAddr:           ipString(session.receiverAddr),
+		toPort:           strconv.Itoa(int(session.receiverPort)),
+		sid:              fmt.Sprintf("%X", session.sid),
+		startTime:        session.startTime,
+		endTime:          session.startTime,
+		dscp:             uint64(session.typeP & 0x3f),
+		lossTimeout:      session.lossTimeout,
+		packetPadding:    uint64(session.paddingLength),
+		sessionPkts:      uint64(session.numPackets),
+		samplePkts:       uint64(len(records)),
+		finished:         session.finished == 1,
+		sync:             len(records) > 0,
+		sentPkts:         uint64(len(records)),
+		latencyHistWidth: bucketWidth,
+	}
+
+	// count duplicates as the received records which were dropped by sortedRecords
+	received := 0
+	for i := range session.records {
+		if !session.records[i].lost() {
+			received++
+		}
+	}
+
+	delays := make([]float64, 0, len(records))
+	latencyHist := make(map[int64]uint64)
+	ttlHist := make(map[int64]uint64)
+	for i := range records {
+		rec := &records[i]
+		if rec.sendTime > ret.endTime {
+			ret.endTime = rec.sendTime
+		}
+		if rec.lost() {
+			ret.lostPkts++
+			continue
+		}
+		received--
+
+		delay := rec.delay()
+		delays = append(delays, delay)
+		latencyHist[int64(math.Floor(delay/bucketWidth))]++
+		if rec.ttl != owpTTLUnknown {
+			ttlHist[int64(rec.ttl)]++
+		}
+
+		if errEst := owpErrEstimate(rec.sendErrEst) + owpErrEstimate(rec.recvErrEst); errEst > ret.maxErr {
+			ret.maxErr = errEst
+		}
+		if !owpErrEstimateSynced(rec.sendErrEst) || !owpErrEstimateSynced(rec.recvErrEst) {
+			ret.sync = false
+		}
+	}
+	ret.dupPkts = uint64(received)
+
+	if len(delays) > 0 {
+		sort.Float64s(delays)
+		ret.latencyMin = delays[0]
+		ret.latencyMed = quantile(delays, 0.5)
+		ret.latencyMax = delays[len(delays)-1]
+	}
+
+	ret.latencyHist = histogramEntries(latencyHist)
+	ret.ttlHist = histogramEntries(ttlHist)
+	if len(ret.ttlHist) > 0 {
+		ret.ttlMin = uint64(ret.ttlHist[0].key)
+		ret.ttlMax = uint64(ret.ttlHist[len(ret.ttlHist)-1].key)
+	}
+
+	return ret
+}
+
+// convert a map of histogram counts into a sorted list of histogram entries
+func histogramEntries(hist map[int64]uint64) []HistogramEntry {
+	ret := make([]HistogramEntry, 0, len(hist))
+	for key, value := range hist {
+		ret = append(ret, HistogramEntry{key, value})
+	}
+	sort.Slice(ret, func(i int, j int) bool {
+		return ret[i].key < ret[j].key
+	})
+	return ret
+}
+
+func ipString(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+// delays in the tests are multiples of this unit, which is exact in OWAMP timestamps
+const testDelayUnit = 1.0 / 1024
+
+// build records with the given delays in units of testDelayUnit, negative delays mark lost packets
+func testRecords(seqNos []uint32, delays []int) []OWPRecord {
+	start := OWTimestamp(0xe0f1a2b300000000)
+	ret := make([]OWPRecord, len(seqNos))
+	for i, seqNo := range seqNos {
+		ret[i] = OWPRecord{seqNo: seqNo, sendTime: start + OWTimestamp(seqNo)<<28}
+		if delays[i] >= 0 {
+			ret[i].recvTime = ret[i].sendTime + OWTimestamp(delays[i])<<22
+		}
+	}
+	return ret
+}
+
+func floatEqual(a float64, b float64) bool {
+	return math.Abs(a-b) < 1e-12
+}
+
+func TestComputeDelayVariation(t *testing.T) {
+	tests := []struct {
+		name   string
+		seqNos []uint32
+		delays []int
+		want   DelayVariation
+	}{
+		{
+			name:   "no packets",
+			seqNos: []uint32{},
+			delays: []int{},
+			want:   DelayVariation{},
+		},
+		{
+			name:   "constant delay",
+			seqNos: []uint32{0, 1, 2},
+			delays: []int{10, 10, 10},
+			want:   DelayVariation{},
+		},
+		{
+			// PDV samples 0 2 1 5 4, IPDV only between 0-1, 1-2 and 4-5: 2 1 1
+			name:   "with loss",
+			seqNos: []uint32{0, 1, 2, 3, 4, 5},
+			delays: []int{10, 12, 11, -1, 15, 14},
+			want: DelayVariation{
+				ipdvMean: 4.0 / 3 * testDelayUnit,
+				ipdvP95:  2 * testDelayUnit,
+				ipdvP99:  2 * testDelayUnit,
+				pdvMean:  12.0 / 5 * testDelayUnit,
+				pdvP95:   5 * testDelayUnit,
+				pdvP99:   5 * testDelayUnit,
+			},
+		},
+		{
+			// the skipped packet 2 breaks the pair 1-3
+			name:   "with gap",
+			seqNos: []uint32{0, 1, 3},
+			delays: []int{10, 11, 20},
+			want: DelayVariation{
+				ipdvMean: 1 * testDelayUnit,
+				ipdvP95:  1 * testDelayUnit,
+				ipdvP99:  1 * testDelayUnit,
+				pdvMean:  11.0 / 3 * testDelayUnit,
+				pdvP95:   10 * testDelayUnit,
+				pdvP99:   10 * testDelayUnit,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		got := ComputeDelayVariation(testRecords(tt.seqNos, tt.delays))
+		gv := []float64{got.ipdvMean, got.ipdvP95, got.ipdvP99, got.pdvMean, got.pdvP95, got.pdvP99}
+		wv := []float64{tt.want.ipdvMean, tt.want.ipdvP95, tt.want.ipdvP99, tt.want.pdvMean, tt.want.pdvP95, tt.want.pdvP99}
+		for i := range gv {
+			if !floatEqual(gv[i], wv[i]) {
+				t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestComputeLossPattern(t *testing.T) {
+	tests := []struct {
+		name   string
+		seqNos []uint32
+		delays []int
+		want   LossPattern
+	}{
+		{
+			name:   "no loss",
+			seqNos: []uint32{0, 1, 2},
+			delays: []int{1, 1, 1},
+			want:   LossPattern{runLengths: []HistogramEntry{}},
+		},
+		{
+			name:   "all lost",
+			seqNos: []uint32{0, 1, 2},
+			delays: []int{-1, -1, -1},
+			want: LossPattern{
+				episodes:   1,
+				burstMean:  3,
+				burstMax:   3,
+				runLengths: []HistogramEntry{{3, 1}},
+			},
+		},
+		{
+			// episodes 1-2, 5, 7-9 (ended by the skipped packet 10) and 11
+			name:   "episodes",
+			seqNos: []uint32{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 11, 12},
+			delays: []int{1, -1, -1, 1, 1, -1, 1, -1, -1, -1, -1, 1},
+			want: LossPattern{
+				episodes:   4,
+				burstMean:  1.75,
+				burstMax:   3,
+				runLengths: []HistogramEntry{{1, 2}, {2, 1}, {3, 1}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		got := ComputeLossPattern(testRecords(tt.seqNos, tt.delays))
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSortedRecords(t *testing.T) {
+	// out of order with a lost record followed by a received duplicate of the same packet
+	records := testRecords([]uint32{2, 0, 1, 1, 0}, []int{5, -1, 3, 4, 6})
+	got := sortedRecords(records)
+
+	want := []OWPRecord{records[4], records[2], records[0]}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestQuantile(t *testing.T) {
+	sorted := []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	tests := []struct {
+		q    float64
+		want float64
+	}{
+		{0, 1},
+		{0.1, 1},
+		{0.5, 5},
+		{0.95, 10},
+		{1, 10},
+	}
+	for _, tt := range tests {
+		if got := quantile(sorted, tt.q); got != tt.want {
+			t.Errorf("quantile(%v) = %v, want %v", tt.q, got, tt.want)
+		}
+	}
+	if got := quantile(nil, 0.5); got != 0 {
+		t.Errorf("quantile of empty slice = %v, want 0", got)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// register a function to run on shutdown after all workers have stopped (e.g. to persist state)
+func (r *Registry) AddShutdownHook(hook func() error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.shutdownHooks = append(r.shutdownHooks, hook)
+}
+
+// stop all measurement workers, wait up to timeout for them to exit and run the shutdown hooks
+func (r *Registry) Shutdown(timeout time.Duration) {
+	// the workers stay registered, so their last reports are still accepted
+	r.mutex.Lock()
+	for _, cancel := range r.workers {
+		cancel()
+	}
+	hooks := r.shutdownHooks
+	r.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Printf("timeout waiting for the measurement workers to stop")
+	}
+
+	for _, hook := range hooks {
+		if err := hook(); err != nil {
+			log.Printf("shutdown hook failed: %v", err)
+		}
+	}
+}
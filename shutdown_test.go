@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// backend which only returns when it is released, not when it is stopped
+type stuckBackend struct {
+	release chan struct{}
+}
+
+func (b stuckBackend) RunWorker(ctx context.Context) {
+	<-b.release
+}
+
+func TestRegistryShutdown(t *testing.T) {
+	running := &sync.Map{}
+	release := make(chan struct{})
+	defer close(release)
+	RegisterMeasurementBackend("test", func(cfg Config, idx uint, outCh chan MeasurementReport) MeasurementBackend {
+		if idx == 1 {
+			return stuckBackend{release: release}
+		}
+		return &testBackend{idx: idx, running: running}
+	})
+	defer delete(measurementBackends, "test")
+
+	r := NewRegistry(testReloadConfig(1, 2))
+	r.StartMeasurements(context.Background())
+	waitTestWorkers(t, running, []uint{0}, true)
+
+	var hooks []string
+	r.AddShutdownHook(func() error {
+		hooks = append(hooks, "first")
+		return errors.New("failed")
+	})
+	r.AddShutdownHook(func() error {
+		hooks = append(hooks, "second")
+		return nil
+	})
+
+	// the hooks run after the timeout even though a worker does not stop
+	start := time.Now()
+	r.Shutdown(200 * time.Millisecond)
+	if d := time.Since(start); d < 200*time.Millisecond || d > 5*time.Second {
+		t.Errorf("shutdown took %v, want the timeout of 200ms", d)
+	}
+	waitTestWorkers(t, running, []uint{0}, false)
+	if len(hooks) != 2 || hooks[0] != "first" || hooks[1] != "second" {
+		t.Errorf("hooks ran %v, want both in order", hooks)
+	}
+}
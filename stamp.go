@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/binary"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// STAMP (RFC 8762) session-reflector and the TLV extensions (RFC 8972)
+//
+// The session-sender is shared with TWAMP-Light (see twamp.go), as both use
+// the same unauthenticated packet layout up to the sender TTL.
+
+const (
+	// unauthenticated base packet of sender and reflector
+	stampPacketSize = 44
+
+	stampTLVHeaderSize = 4
+
+	stampTLVFlagUnrecognized = 0x80
+	stampTLVFlagMalformed    = 0x40
+
+	stampTLVTypeTimestampInfo = 3
+
+	// values of the Timestamp Information TLV
+	stampSyncSourceNTP         = 1
+	stampSyncSourcePTP         = 2
+	stampSyncSourceGNSS        = 4
+	stampSyncSourceFreeRunning = 5
+	stampTimestampSWLocal      = 2
+)
+
+var stampSyncSources = map[string]uint8{
+	"ntp":          stampSyncSourceNTP,
+	"ptp":          stampSyncSourcePTP,
+	"gnss":         stampSyncSourceGNSS,
+	"free-running": stampSyncSourceFreeRunning,
+}
+
+// information derived from the TLVs returned by the session-reflector
+type STAMPReport struct {
+	tlvPackets   uint64
+	unrecognized uint64
+	malformed    uint64
+
+	// Timestamp Information TLV of the last reflected packet
+	syncSourceIn     uint8
+	timestampMethIn  uint8
+	syncSourceOut    uint8
+	timestampMethOut uint8
+}
+
+// build the session-sender packet template, optionally with an empty Timestamp Information TLV
+func makeSTAMPPacket(withTLVs bool) []byte {
+	if !withTLVs {
+		return make([]byte, stampPacketSize)
+	}
+	b := make([]byte, stampPacketSize+stampTLVHeaderSize+4)
+	b[stampPacketSize+1] = stampTLVTypeTimestampInfo
+	binary.BigEndian.PutUint16(b[stampPacketSize+2:], 4)
+	return b
+}
+
+// visit all TLVs in b; stops at the first malformed TLV and returns false in that case
+func visitSTAMPTLVs(b []byte, f func(tlv []byte) bool) bool {
+	for len(b) > 0 {
+		if len(b) < stampTLVHeaderSize {
+			return false
+		}
+		length := int(binary.BigEndian.Uint16(b[2:4]))
+		if len(b) < stampTLVHeaderSize+length {
+			return false
+		}
+		if !f(b[:stampTLVHeaderSize+length]) {
+			return true
+		}
+		b = b[stampTLVHeaderSize+length:]
+	}
+	return true
+}
+
+func analyzeSTAMPTLVs(packets map[uint32]reflectedPacket) *STAMPReport {
+	ret := &STAMPReport{}
+	var last uint32
+	for seq, pkt := range packets {
+		if len(pkt.tail) == 0 {
+			continue
+		}
+		ret.tlvPackets++
+		ok := visitSTAMPTLVs(pkt.tail, func(tlv []byte) bool {
+			if tlv[0]&stampTLVFlagUnrecognized != 0 {
+				ret.unrecognized++
+			}
+			if tlv[0]&stampTLVFlagMalformed != 0 {
+				ret.malformed++
+			}
+			if tlv[1] == stampTLVTypeTimestampInfo && len(tlv) >= stampTLVHeaderSize+4 && seq >= last {
+				last = seq
+				ret.syncSourceIn = tlv[4]
+				ret.timestampMethIn = tlv[5]
+				ret.syncSourceOut = tlv[6]
+				ret.timestampMethOut = tlv[7]
+			}
+			return true
+		})
+		if !ok {
+			ret.malformed++
+		}
+	}
+	return ret
+}
+
+type ReflectorCfg struct {
+	enabled    bool
+	listenAddr string
+	syncSource uint8
+}
+
+type ReflectorStats struct {
+	packetsReflected uint64
+	packetsMalformed uint64
+	tlvUnrecognized  uint64
+}
+
+// stateless STAMP session-reflector
+type STAMPReflector struct {
+	cfg   ReflectorCfg
+	stats ReflectorStats
+}
+
+func NewSTAMPReflector(cfg ReflectorCfg) *STAMPReflector {
+	return &STAMPReflector{cfg: cfg}
+}
+
+func (refl *STAMPReflector) ListenAndServe() error {
+	addr, err := net.ResolveUDPAddr("udp", refl.cfg.listenAddr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return err
+	}
+	return refl.Serve(conn)
+}
+
+func (refl *STAMPReflector) Serve(conn *net.UDPConn) error {
+	buf := make([]byte, 65536)
+	out := make([]byte, 65536)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+		recvTime := OWTimestampFromTime(time.Now())
+		if n < owampTestPacketSize {
+			atomic.AddUint64(&refl.stats.packetsMalformed, 1)
+			continue
+		}
+		// TWAMP-Light senders may send less than the base packet, the reply is never shorter than it
+		size := n
+		if size < stampPacketSize {
+			size = stampPacketSize
+		}
+		reply := refl.reflect(buf[:n], out[:size], recvTime)
+		if _, err = conn.WriteToUDP(reply, addr); err != nil {
+			log.Printf("reflector: failed to reflect packet to %s: %v", addr, err)
+			continue
+		}
+		atomic.AddUint64(&refl.stats.packetsReflected, 1)
+	}
+}
+
+// build the reflected packet in out (of the length of the received one, but at least the base packet)
+func (refl *STAMPReflector) reflect(in []byte, out []byte, recvTime OWTimestamp) []byte {
+	for i := range out[:stampPacketSize] {
+		out[i] = 0
+	}
+	// stateless mode: the reflector sequence number is copied from the sender
+	copy(out[0:4], in[0:4])
+	binary.BigEndian.PutUint16(out[12:14], owampDefaultErrEstimate)
+	binary.BigEndian.PutUint64(out[16:24], uint64(recvTime))
+	copy(out[24:38], in[0:14])
+	// the TTL of the received packet is not available
+	out[40] = owpTTLUnknown
+
+	// reflect the TLVs, filling in the ones we know
+	tail := out[stampPacketSize:]
+	if len(in) > stampPacketSize {
+		copy(tail, in[stampPacketSize:])
+	}
+	ok := visitSTAMPTLVs(tail, func(tlv []byte) bool {
+		switch tlv[1] {
+		case stampTLVTypeTimestampInfo:
+			if len(tlv) >= stampTLVHeaderSize+4 {
+				tlv[4] = refl.cfg.syncSource
+				tlv[5] = stampTimestampSWLocal
+				tlv[6] = refl.cfg.syncSource
+				tlv[7] = stampTimestampSWLocal
+			}
+		default:
+			tlv[0] |= stampTLVFlagUnrecognized
+			atomic.AddUint64(&refl.stats.tlvUnrecognized, 1)
+		}
+		return true
+	})
+	if !ok {
+		atomic.AddUint64(&refl.stats.packetsMalformed, 1)
+	}
+
+	binary.BigEndian.PutUint64(out[4:12], uint64(OWTimestampFromTime(time.Now())))
+	return out
+}
+
+func (refl *STAMPReflector) WriteMetrics(me metricEmitter) {
+	stats := []struct {
+		name  string
+		value uint64
+	}{
+		{"owamp_stamp_reflector_packets_total", atomic.LoadUint64(&refl.stats.packetsReflected)},
+		{"owamp_stamp_reflector_packets_malformed_total", atomic.LoadUint64(&refl.stats.packetsMalformed)},
+		{"owamp_stamp_reflector_tlv_unrecognized_total", atomic.LoadUint64(&refl.stats.tlvUnrecognized)},
+	}
+	for _, stat := range stats {
+		me.add(stat.name, nil, float64(stat.value))
+	}
+}
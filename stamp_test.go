@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+// run a STAMP reflector on an ephemeral port of the loopback interface
+func startTestReflector(t *testing.T, cfg ReflectorCfg) (*STAMPReflector, *net.UDPAddr) {
+	t.Helper()
+	conn := listenTestUDP(t)
+	refl := NewSTAMPReflector(cfg)
+	go refl.Serve(conn)
+	return refl, conn.LocalAddr().(*net.UDPAddr)
+}
+
+func TestMakeSTAMPPacket(t *testing.T) {
+	if b := makeSTAMPPacket(false); len(b) != stampPacketSize {
+		t.Errorf("packet without TLVs has %d bytes, want %d", len(b), stampPacketSize)
+	}
+
+	b := makeSTAMPPacket(true)
+	want := append(make([]byte, stampPacketSize), 0, stampTLVTypeTimestampInfo, 0, 4, 0, 0, 0, 0)
+	if !reflect.DeepEqual(b, want) {
+		t.Errorf("packet with TLVs = %v, want %v", b, want)
+	}
+}
+
+func TestVisitSTAMPTLVs(t *testing.T) {
+	tests := []struct {
+		name  string
+		tail  []byte
+		types []byte
+		ok    bool
+	}{
+		{"empty", nil, nil, true},
+		{"two TLVs", []byte{0, 3, 0, 4, 1, 2, 3, 4, 0, 9, 0, 0}, []byte{3, 9}, true},
+		{"truncated header", []byte{0, 3, 0, 0, 0, 3}, []byte{3}, false},
+		{"truncated value", []byte{0, 3, 0, 4, 1, 2}, nil, false},
+	}
+	for _, tt := range tests {
+		var types []byte
+		ok := visitSTAMPTLVs(tt.tail, func(tlv []byte) bool {
+			types = append(types, tlv[1])
+			return true
+		})
+		if ok != tt.ok || !reflect.DeepEqual(types, tt.types) {
+			t.Errorf("%s: visited %v (ok %v), want %v (ok %v)", tt.name, types, ok, tt.types, tt.ok)
+		}
+	}
+}
+
+func TestSTAMPReflect(t *testing.T) {
+	refl := NewSTAMPReflector(ReflectorCfg{syncSource: stampSyncSourcePTP})
+
+	// sender packet with a Timestamp Information TLV and an unknown TLV
+	in := append(makeSTAMPPacket(true), 0, 200, 0, 2, 0xaa, 0xbb)
+	encodeTestPacket(in, 9, 0x1000, 0x8001)
+	out := make([]byte, len(in))
+	reply := refl.reflect(in, out, 0x2000)
+
+	pkt, err := parseReflectedPacket(reply, 0x3000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkt.seqNo != 9 || pkt.sendTime != 0x1000 || pkt.sendErrEst != 0x8001 || pkt.reflRecvTime != 0x2000 || pkt.senderTTL != owpTTLUnknown {
+		t.Errorf("unexpected reflected packet %+v", pkt)
+	}
+	if seq := binary.BigEndian.Uint32(reply[0:4]); seq != 9 {
+		t.Errorf("reflector sequence number = %d, want 9", seq)
+	}
+	wantTail := []byte{
+		0, stampTLVTypeTimestampInfo, 0, 4, stampSyncSourcePTP, stampTimestampSWLocal, stampSyncSourcePTP, stampTimestampSWLocal,
+		stampTLVFlagUnrecognized, 200, 0, 2, 0xaa, 0xbb,
+	}
+	if !reflect.DeepEqual(pkt.tail, wantTail) {
+		t.Errorf("reflected TLVs = %v, want %v", pkt.tail, wantTail)
+	}
+	if refl.stats.tlvUnrecognized != 1 {
+		t.Errorf("unrecognized TLVs = %d, want 1", refl.stats.tlvUnrecognized)
+	}
+
+	// the unauthenticated TWAMP-Light packet is shorter than the reply
+	in = make([]byte, owampTestPacketSize)
+	encodeTestPacket(in, 3, 0x1000, 0x8001)
+	reply = refl.reflect(in, make([]byte, stampPacketSize), 0x2000)
+	if pkt, err = parseReflectedPacket(reply, 0x3000); err != nil || pkt.seqNo != 3 || pkt.tail != nil {
+		t.Errorf("TWAMP-Light reply: got %+v, %v", pkt, err)
+	}
+}
+
+func TestAnalyzeSTAMPTLVs(t *testing.T) {
+	tlv := func(flags byte, syncSource byte) []byte {
+		return []byte{flags, stampTLVTypeTimestampInfo, 0, 4, syncSource, stampTimestampSWLocal, syncSource, stampTimestampSWLocal}
+	}
+	packets := map[uint32]reflectedPacket{
+		0: {seqNo: 0},
+		1: {seqNo: 1, tail: tlv(0, stampSyncSourceNTP)},
+		// the last packet determines the reported sync source
+		2: {seqNo: 2, tail: tlv(stampTLVFlagMalformed, stampSyncSourceGNSS)},
+		// truncated TLV, its flags are not looked at
+		3: {seqNo: 3, tail: append(tlv(stampTLVFlagUnrecognized, 0)[:6:6], 0xff)},
+	}
+	got := analyzeSTAMPTLVs(packets)
+	want := &STAMPReport{
+		tlvPackets:       3,
+		unrecognized:     0,
+		malformed:        2,
+		syncSourceIn:     stampSyncSourceGNSS,
+		timestampMethIn:  stampTimestampSWLocal,
+		syncSourceOut:    stampSyncSourceGNSS,
+		timestampMethOut: stampTimestampSWLocal,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+// STAMP session of the worker with TLVs against the built-in reflector
+func TestSTAMPWorkerRoundTrip(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for the start delay and loss timeout of a native session")
+	}
+	refl, addr := startTestReflector(t, ReflectorCfg{syncSource: stampSyncSourceGNSS})
+
+	cfg := Config{
+		targets: map[string]TargetCfg{
+			"src": {hostname: "127.0.0.1", local: true},
+			"dst": {hostname: "127.0.0.1"},
+		},
+		measurements: map[uint]MeasurementCfg{
+			0: {targetSrc: "src", targetDst: "dst", pps: 10, duration: 1, protocol: "stamp", port: uint64(addr.Port), stampTLVs: true},
+		},
+	}
+	w := NewTWAMPWorker(cfg, 0, nil)
+	res, err := w.runSession(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(res.forward.records); n != 10 {
+		t.Fatalf("got %d records, want 10", n)
+	}
+	for _, sess := range []OWPSession{res.forward, res.reverse, res.roundTrip} {
+		for _, rec := range sess.records {
+			if rec.lost() {
+				t.Errorf("packet %d lost on loopback", rec.seqNo)
+			}
+		}
+	}
+	if want := strconv.Itoa(addr.Port); SummarizeSession(&res.forward, 0.0001).toPort != want {
+		t.Errorf("forward session is not addressed to the reflector port %s", want)
+	}
+	if res.stamp == nil || res.stamp.tlvPackets != 10 || res.stamp.syncSourceIn != stampSyncSourceGNSS || res.stamp.unrecognized != 0 {
+		t.Errorf("unexpected STAMP report %+v", res.stamp)
+	}
+	if n := atomic.LoadUint64(&refl.stats.packetsReflected); n != 10 {
+		t.Errorf("reflector reflected %d packets, want 10", n)
+	}
+}
@@ -0,0 +1,540 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// persistence of the registry state across restarts
+//
+// The last reports, session statistics, totals and window histories are
+// written as versioned JSON to the state file, replacing it atomically. On
+// startup the entries are matched to the configured measurements by their key,
+// entries of measurements which are no longer configured (or were changed) are
+// dropped.
+
+const registryStateVersion = 1
+
+type registryState struct {
+	Version      int                `json:"version"`
+	Measurements []measurementState `json:"measurements"`
+}
+
+type measurementState struct {
+	Key     string               `json:"key"`
+	Report  *reportState         `json:"report,omitempty"`
+	Session *sessionStatsState   `json:"session,omitempty"`
+	Totals  *totalsState         `json:"totals,omitempty"`
+	History []windowSessionState `json:"history,omitempty"`
+}
+
+type reportState struct {
+	MetricsTimestamp OWTimestamp  `json:"metrics_timestamp"`
+	Summary          summaryState `json:"summary"`
+	TwoWay           *twoWayState `json:"two_way,omitempty"`
+}
+
+type histogramEntryState struct {
+	Key   int64  `json:"key"`
+	Value uint64 `json:"value"`
+}
+
+// section tables by name
+type sectionsState map[string][]sectionRowState
+
+type sectionRowState struct {
+	Key    string    `json:"key"`
+	Values []float64 `json:"values"`
+}
+
+type summaryState struct {
+	SummaryVersion   string                `json:"summary_version"`
+	SID              string                `json:"sid"`
+	FromHost         string                `json:"from_host"`
+	FromAddr         string                `json:"from_addr"`
+	FromPort         string                `json:"from_port"`
+	ToHost           string                `json:"to_host"`
+	ToAddr           string                `json:"to_addr"`
+	ToPort           string                `json:"to_port"`
+	StartTime        OWTimestamp           `json:"start_time"`
+	EndTime          OWTimestamp           `json:"end_time"`
+	DSCP             uint64                `json:"dscp"`
+	LossTimeout      uint64                `json:"loss_timeout"`
+	PacketPadding    uint64                `json:"packet_padding"`
+	SessionPkts      uint64                `json:"session_packets"`
+	SamplePkts       uint64                `json:"sample_packets"`
+	Finished         bool                  `json:"finished"`
+	Sync             bool                  `json:"sync"`
+	SentPkts         uint64                `json:"sent_packets"`
+	DupPkts          uint64                `json:"dup_packets"`
+	LostPkts         uint64                `json:"lost_packets"`
+	ErrorPkts        uint64                `json:"error_packets"`
+	MaxErr           float64               `json:"max_err"`
+	LatencyMin       float64               `json:"latency_min"`
+	LatencyMax       float64               `json:"latency_max"`
+	LatencyMed       float64               `json:"latency_median"`
+	LatencyPDV       float64               `json:"latency_pdv"`
+	TTLMin           uint64                `json:"ttl_min"`
+	TTLMax           uint64                `json:"ttl_max"`
+	LatencyHistWidth float64               `json:"latency_hist_width"`
+	LatencyHist      []histogramEntryState `json:"latency_hist"`
+	TTLHist          []histogramEntryState `json:"ttl_hist"`
+	ReorderingHist   []histogramEntryState `json:"reordering_hist"`
+	Sections         sectionsState         `json:"sections,omitempty"`
+	UnknownKeys      uint64                `json:"unknown_keys"`
+}
+
+type twoWayState struct {
+	RoundTrip summaryState `json:"round_trip"`
+	Reverse   summaryState `json:"reverse"`
+	Stamp     *stampState  `json:"stamp,omitempty"`
+}
+
+type stampState struct {
+	TLVPackets       uint64 `json:"tlv_packets"`
+	Unrecognized     uint64 `json:"unrecognized"`
+	Malformed        uint64 `json:"malformed"`
+	SyncSourceIn     uint8  `json:"sync_source_in"`
+	TimestampMethIn  uint8  `json:"timestamp_method_in"`
+	SyncSourceOut    uint8  `json:"sync_source_out"`
+	TimestampMethOut uint8  `json:"timestamp_method_out"`
+}
+
+type sessionStatsState struct {
+	Timestamp    OWTimestamp           `json:"timestamp"`
+	IPDVMean     float64               `json:"ipdv_mean"`
+	IPDVP95      float64               `json:"ipdv_p95"`
+	IPDVP99      float64               `json:"ipdv_p99"`
+	PDVMean      float64               `json:"pdv_mean"`
+	PDVP95       float64               `json:"pdv_p95"`
+	PDVP99       float64               `json:"pdv_p99"`
+	LossEpisodes uint64                `json:"loss_episodes"`
+	BurstMean    float64               `json:"burst_mean"`
+	BurstMax     uint64                `json:"burst_max"`
+	RunLengths   []histogramEntryState `json:"run_lengths"`
+}
+
+func histogramToState(hist []HistogramEntry) []histogramEntryState {
+	if hist == nil {
+		return nil
+	}
+	ret := make([]histogramEntryState, len(hist))
+	for i, e := range hist {
+		ret[i] = histogramEntryState{Key: e.key, Value: e.value}
+	}
+	return ret
+}
+
+func sectionsToState(sections map[string][]SummarySectionRow) sectionsState {
+	if sections == nil {
+		return nil
+	}
+	ret := make(sectionsState, len(sections))
+	for name, rows := range sections {
+		ret[name] = make([]sectionRowState, len(rows))
+		for i, row := range rows {
+			ret[name][i] = sectionRowState{Key: row.key, Values: row.values}
+		}
+	}
+	return ret
+}
+
+func sectionsFromState(sections sectionsState) map[string][]SummarySectionRow {
+	if sections == nil {
+		return nil
+	}
+	ret := make(map[string][]SummarySectionRow, len(sections))
+	for name, rows := range sections {
+		ret[name] = make([]SummarySectionRow, len(rows))
+		for i, row := range rows {
+			ret[name][i] = SummarySectionRow{key: row.Key, values: row.Values}
+		}
+	}
+	return ret
+}
+
+func histogramFromState(hist []histogramEntryState) []HistogramEntry {
+	if hist == nil {
+		return nil
+	}
+	ret := make([]HistogramEntry, len(hist))
+	for i, e := range hist {
+		ret[i] = HistogramEntry{key: e.Key, value: e.Value}
+	}
+	return ret
+}
+
+func summaryToState(s *SummaryReport) summaryState {
+	return summaryState{
+		SummaryVersion:   s.summaryVersion,
+		SID:              s.sid,
+		FromHost:         s.fromHost,
+		FromAddr:         s.fromAddr,
+		FromPort:         s.fromPort,
+		ToHost:           s.toHost,
+		ToAddr:           s.toAddr,
+		ToPort:           s.toPort,
+		StartTime:        s.startTime,
+		EndTime:          s.endTime,
+		DSCP:             s.dscp,
+		LossTimeout:      s.lossTimeout,
+		PacketPadding:    s.packetPadding,
+		SessionPkts:      s.sessionPkts,
+		SamplePkts:       s.samplePkts,
+		Finished:         s.finished,
+		Sync:             s.sync,
+		SentPkts:         s.sentPkts,
+		DupPkts:          s.dupPkts,
+		LostPkts:         s.lostPkts,
+		ErrorPkts:        s.errorPkts,
+		MaxErr:           s.maxErr,
+		LatencyMin:       s.latencyMin,
+		LatencyMax:       s.latencyMax,
+		LatencyMed:       s.latencyMed,
+		LatencyPDV:       s.latencyPDV,
+		TTLMin:           s.ttlMin,
+		TTLMax:           s.ttlMax,
+		LatencyHistWidth: s.latencyHistWidth,
+		LatencyHist:      histogramToState(s.latencyHist),
+		TTLHist:          histogramToState(s.ttlHist),
+		ReorderingHist:   histogramToState(s.reorderingHist),
+		Sections:         sectionsToState(s.sections),
+		UnknownKeys:      s.unknownKeys,
+	}
+}
+
+func summaryFromState(s *summaryState) SummaryReport {
+	return SummaryReport{
+		summaryVersion:   s.SummaryVersion,
+		sid:              s.SID,
+		fromHost:         s.FromHost,
+		fromAddr:         s.FromAddr,
+		fromPort:         s.FromPort,
+		toHost:           s.ToHost,
+		toAddr:           s.ToAddr,
+		toPort:           s.ToPort,
+		startTime:        s.StartTime,
+		endTime:          s.EndTime,
+		dscp:             s.DSCP,
+		lossTimeout:      s.LossTimeout,
+		packetPadding:    s.PacketPadding,
+		sessionPkts:      s.SessionPkts,
+		samplePkts:       s.SamplePkts,
+		finished:         s.Finished,
+		sync:             s.Sync,
+		sentPkts:         s.SentPkts,
+		dupPkts:          s.DupPkts,
+		lostPkts:         s.LostPkts,
+		errorPkts:        s.ErrorPkts,
+		maxErr:           s.MaxErr,
+		latencyMin:       s.LatencyMin,
+		latencyMax:       s.LatencyMax,
+		latencyMed:       s.LatencyMed,
+		latencyPDV:       s.LatencyPDV,
+		ttlMin:           s.TTLMin,
+		ttlMax:           s.TTLMax,
+		latencyHistWidth: s.LatencyHistWidth,
+		latencyHist:      histogramFromState(s.LatencyHist),
+		ttlHist:          histogramFromState(s.TTLHist),
+		reorderingHist:   histogramFromState(s.ReorderingHist),
+		sections:         sectionsFromState(s.Sections),
+		unknownKeys:      s.UnknownKeys,
+	}
+}
+
+func reportToState(report *MeasurementReport) *reportState {
+	ret := &reportState{
+		MetricsTimestamp: report.metricsTimestamp,
+		Summary:          summaryToState(report.summary),
+	}
+	if tw := report.twoWay; tw != nil {
+		ret.TwoWay = &twoWayState{
+			RoundTrip: summaryToState(&tw.roundTrip),
+			Reverse:   summaryToState(&tw.reverse),
+		}
+		if st := tw.stamp; st != nil {
+			ret.TwoWay.Stamp = &stampState{
+				TLVPackets:       st.tlvPackets,
+				Unrecognized:     st.unrecognized,
+				Malformed:        st.malformed,
+				SyncSourceIn:     st.syncSourceIn,
+				TimestampMethIn:  st.timestampMethIn,
+				SyncSourceOut:    st.syncSourceOut,
+				TimestampMethOut: st.timestampMethOut,
+			}
+		}
+	}
+	return ret
+}
+
+func reportFromState(idx uint, s *reportState) MeasurementReport {
+	summary := summaryFromState(&s.Summary)
+	ret := MeasurementReport{
+		measurementIdx:   idx,
+		metricsTimestamp: s.MetricsTimestamp,
+		summary:          &summary,
+	}
+	if tw := s.TwoWay; tw != nil {
+		ret.twoWay = &TwoWayReport{
+			roundTrip: summaryFromState(&tw.RoundTrip),
+			reverse:   summaryFromState(&tw.Reverse),
+		}
+		if st := tw.Stamp; st != nil {
+			ret.twoWay.stamp = &STAMPReport{
+				tlvPackets:       st.TLVPackets,
+				unrecognized:     st.Unrecognized,
+				malformed:        st.Malformed,
+				syncSourceIn:     st.SyncSourceIn,
+				timestampMethIn:  st.TimestampMethIn,
+				syncSourceOut:    st.SyncSourceOut,
+				timestampMethOut: st.TimestampMethOut,
+			}
+		}
+	}
+	return ret
+}
+
+func sessionStatsToState(s *SessionStats) *sessionStatsState {
+	return &sessionStatsState{
+		Timestamp:    s.timestamp,
+		IPDVMean:     s.delayVariation.ipdvMean,
+		IPDVP95:      s.delayVariation.ipdvP95,
+		IPDVP99:      s.delayVariation.ipdvP99,
+		PDVMean:      s.delayVariation.pdvMean,
+		PDVP95:       s.delayVariation.pdvP95,
+		PDVP99:       s.delayVariation.pdvP99,
+		LossEpisodes: s.lossPattern.episodes,
+		BurstMean:    s.lossPattern.burstMean,
+		BurstMax:     s.lossPattern.burstMax,
+		RunLengths:   histogramToState(s.lossPattern.runLengths),
+	}
+}
+
+type totalsState struct {
+	Sessions         uint64                `json:"sessions"`
+	SentPkts         uint64                `json:"sent_packets"`
+	LostPkts         uint64                `json:"lost_packets"`
+	DupPkts          uint64                `json:"dup_packets"`
+	LastStart        OWTimestamp           `json:"last_start"`
+	LatencyHistWidth float64               `json:"latency_hist_width"`
+	LatencyHist      []histogramEntryState `json:"latency_hist"`
+}
+
+func totalsToState(t *MeasurementTotals) *totalsState {
+	return &totalsState{
+		Sessions:         t.sessions,
+		SentPkts:         t.sentPkts,
+		LostPkts:         t.lostPkts,
+		DupPkts:          t.dupPkts,
+		LastStart:        t.lastStart,
+		LatencyHistWidth: t.latencyHistWidth,
+		LatencyHist:      histogramToState(t.latencyHistogram()),
+	}
+}
+
+func totalsFromState(s *totalsState) *MeasurementTotals {
+	ret := NewMeasurementTotals()
+	ret.sessions = s.Sessions
+	ret.sentPkts = s.SentPkts
+	ret.lostPkts = s.LostPkts
+	ret.dupPkts = s.DupPkts
+	ret.lastStart = s.LastStart
+	ret.latencyHistWidth = s.LatencyHistWidth
+	for _, e := range s.LatencyHist {
+		ret.latencyHist[e.Key] += e.Value
+	}
+	return ret
+}
+
+type windowSessionState struct {
+	StartTime        OWTimestamp           `json:"start_time"`
+	EndTime          time.Time             `json:"end_time"`
+	SentPkts         uint64                `json:"sent_packets"`
+	LostPkts         uint64                `json:"lost_packets"`
+	DupPkts          uint64                `json:"dup_packets"`
+	LatencyMin       float64               `json:"latency_min"`
+	LatencyMax       float64               `json:"latency_max"`
+	LatencyHistWidth float64               `json:"latency_hist_width"`
+	LatencyHist      []histogramEntryState `json:"latency_hist"`
+}
+
+func historyToState(h *MeasurementHistory) []windowSessionState {
+	ret := make([]windowSessionState, len(h.sessions))
+	for i, s := range h.sessions {
+		ret[i] = windowSessionState{
+			StartTime:        s.startTime,
+			EndTime:          s.endTime,
+			SentPkts:         s.sentPkts,
+			LostPkts:         s.lostPkts,
+			DupPkts:          s.dupPkts,
+			LatencyMin:       s.latencyMin,
+			LatencyMax:       s.latencyMax,
+			LatencyHistWidth: s.latencyHistWidth,
+			LatencyHist:      histogramToState(s.latencyHist),
+		}
+	}
+	return ret
+}
+
+func historyFromState(s []windowSessionState) *MeasurementHistory {
+	ret := &MeasurementHistory{sessions: make([]windowSession, len(s))}
+	for i, e := range s {
+		ret.sessions[i] = windowSession{
+			startTime:        e.StartTime,
+			endTime:          e.EndTime,
+			sentPkts:         e.SentPkts,
+			lostPkts:         e.LostPkts,
+			dupPkts:          e.DupPkts,
+			latencyMin:       e.LatencyMin,
+			latencyMax:       e.LatencyMax,
+			latencyHistWidth: e.LatencyHistWidth,
+			latencyHist:      histogramFromState(e.LatencyHist),
+		}
+	}
+	return ret
+}
+
+func sessionStatsFromState(s *sessionStatsState) SessionStats {
+	return SessionStats{
+		timestamp: s.Timestamp,
+		delayVariation: DelayVariation{
+			ipdvMean: s.IPDVMean,
+			ipdvP95:  s.IPDVP95,
+			ipdvP99:  s.IPDVP99,
+			pdvMean:  s.PDVMean,
+			pdvP95:   s.PDVP95,
+			pdvP99:   s.PDVP99,
+		},
+		lossPattern: LossPattern{
+			episodes:   s.LossEpisodes,
+			burstMean:  s.BurstMean,
+			burstMax:   s.BurstMax,
+			runLengths: histogramFromState(s.RunLengths),
+		},
+	}
+}
+
+// write the reports of the running measurements to the state file
+func (r *Registry) SaveState() error {
+	r.mutex.Lock()
+	path := r.cfg.stateFile
+	state := registryState{
+		Version:      registryStateVersion,
+		Measurements: make([]measurementState, 0, len(r.workers)),
+	}
+	for idx := range r.workers {
+		ms := measurementState{Key: measurementKey(r.cfg, r.cfg.measurements[idx])}
+		if report, found := r.reports[idx]; found {
+			ms.Report = reportToState(&report)
+		}
+		if stats, found := r.sessions[idx]; found {
+			ms.Session = sessionStatsToState(&stats)
+		}
+		if totals, found := r.totals[idx]; found {
+			ms.Totals = totalsToState(totals)
+		}
+		if history, found := r.histories[idx]; found && len(history.sessions) > 0 {
+			ms.History = historyToState(history)
+		}
+		if ms.Report != nil || ms.Session != nil || ms.Totals != nil || ms.History != nil {
+			state.Measurements = append(state.Measurements, ms)
+		}
+	}
+	r.mutex.Unlock()
+
+	if path == "" {
+		return nil
+	}
+	data, err := json.Marshal(&state)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// load the state file, only keeping the entries of measurements in the current configuration
+func (r *Registry) LoadState() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	data, err := os.ReadFile(r.cfg.stateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	state := registryState{}
+	if err = json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	if state.Version != registryStateVersion {
+		return fmt.Errorf("unsupported state file version %d", state.Version)
+	}
+
+	byKey := make(map[string]uint)
+	for idx, mcfg := range r.cfg.measurements {
+		byKey[measurementKey(r.cfg, mcfg)] = uint(idx)
+	}
+	loaded := 0
+	for _, ms := range state.Measurements {
+		idx, found := byKey[ms.Key]
+		if !found {
+			continue
+		}
+		if ms.Report != nil {
+			r.reports[idx] = reportFromState(idx, ms.Report)
+		}
+		if ms.Session != nil {
+			r.sessions[idx] = sessionStatsFromState(ms.Session)
+		}
+		if ms.Totals != nil {
+			r.totals[idx] = totalsFromState(ms.Totals)
+		}
+		if len(ms.History) > 0 && r.cfg.maxWindowLength() > 0 {
+			history := historyFromState(ms.History)
+			history.prune(time.Now().Add(-r.cfg.maxWindowLength()))
+			r.histories[idx] = history
+		}
+		loaded++
+	}
+	log.Printf("loaded state of %d measurements (%d dropped)", loaded, len(state.Measurements)-loaded)
+	return nil
+}
+
+// save the state periodically until ctx is cancelled
+func (r *Registry) RunStateSaver(ctx context.Context, interval time.Duration) {
+	for sleepContext(ctx, interval) {
+		if err := r.SaveState(); err != nil {
+			log.Printf("failed to save state: %v", err)
+		}
+	}
+}
+
+// replace the file by writing to a temporary file in the same directory and renaming it
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// compare the histories, the end times are loaded in a different location
+func equalTestHistories(a *MeasurementHistory, b *MeasurementHistory) bool {
+	if len(a.sessions) != len(b.sessions) {
+		return false
+	}
+	for i := range a.sessions {
+		sa, sb := a.sessions[i], b.sessions[i]
+		if !sa.endTime.Equal(sb.endTime) {
+			return false
+		}
+		sa.endTime, sb.endTime = time.Time{}, time.Time{}
+		if !reflect.DeepEqual(sa, sb) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRegistryStateRoundTrip(t *testing.T) {
+	running := &sync.Map{}
+	RegisterMeasurementBackend("test", func(cfg Config, idx uint, outCh chan MeasurementReport) MeasurementBackend {
+		return &testBackend{idx: idx, running: running}
+	})
+	defer delete(measurementBackends, "test")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	cfg := testReloadConfig(1, 2, 3)
+	cfg.stateFile = stateFile
+	cfg.windows = []WindowCfg{{name: "1h", length: time.Hour}}
+	r := NewRegistry(cfg)
+	r.StartMeasurements(ctx)
+
+	summary, err := ParseSummary(bufio.NewReader(strings.NewReader(testSummary)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := MeasurementReport{measurementIdx: 0, metricsTimestamp: summary.endTime, summary: &summary}
+	stats := AnalyzeSession(&OWPSession{records: testRecords([]uint32{0, 1, 2, 3}, []int{10, -1, 12, 30})})
+	totals := NewMeasurementTotals()
+	totals.merge(&summary)
+	history := &MeasurementHistory{}
+	history.add(&SummaryReport{startTime: OWTimestampFromTime(time.Now().Add(-2 * time.Minute)),
+		endTime: OWTimestampFromTime(time.Now().Add(-time.Minute)), sentPkts: 10, latencyHistWidth: 0.001,
+		latencyHist: []HistogramEntry{{1, 10}}}, 0)
+
+	r.mutex.Lock()
+	r.reports[0] = report
+	r.sessions[0] = stats
+	r.totals[0] = totals
+	r.histories[0] = history
+	// dropped as its measurement is removed from the configuration
+	r.reports[1] = report
+	r.sessions[2] = stats
+	r.mutex.Unlock()
+	if err = r.SaveState(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the measurement with pps 3 moves to index 1, the one with pps 2 is removed
+	cfg = testReloadConfig(1, 3)
+	cfg.stateFile = stateFile
+	cfg.windows = []WindowCfg{{name: "1h", length: time.Hour}}
+	loaded := NewRegistry(cfg)
+	if err = loaded.LoadState(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(loaded.reports, map[uint]MeasurementReport{0: report}) {
+		t.Errorf("reports differ\n got: %+v\nwant: %+v", loaded.reports, report)
+	}
+	if !reflect.DeepEqual(loaded.sessions, map[uint]SessionStats{0: stats, 1: stats}) {
+		t.Errorf("session stats differ\n got: %+v\nwant: %+v", loaded.sessions, stats)
+	}
+	if !reflect.DeepEqual(loaded.totals, map[uint]*MeasurementTotals{0: totals}) {
+		t.Errorf("totals differ\n got: %+v\nwant: %+v", loaded.totals[0], totals)
+	}
+	if got := loaded.histories[0]; len(loaded.histories) != 1 || got == nil || !equalTestHistories(got, history) {
+		t.Errorf("histories differ\n got: %+v\nwant: %+v", got, history)
+	}
+}
+
+func TestRegistryLoadStateErrors(t *testing.T) {
+	dir := t.TempDir()
+	cfg := testReloadConfig(1)
+
+	// a missing state file is not an error
+	cfg.stateFile = filepath.Join(dir, "missing.json")
+	if err := NewRegistry(cfg).LoadState(); err != nil {
+		t.Errorf("missing state file: %v", err)
+	}
+
+	for name, content := range map[string]string{
+		"invalid.json": "{",
+		"version.json": `{"version": 2, "measurements": []}`,
+	} {
+		cfg.stateFile = filepath.Join(dir, name)
+		if err := os.WriteFile(cfg.stateFile, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := NewRegistry(cfg).LoadState(); err == nil {
+			t.Errorf("%s: state loaded", name)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// supervision of the measurement processes (restart backoff, exit classification and status metrics)
+
+const (
+	workerBackoffMin = 5 * time.Second
+	workerBackoffMax = 10 * time.Minute
+	// a process running at least this long is considered healthy and resets the backoff
+	workerStableRuntime = 10 * time.Minute
+
+	workerExitCode         = "exit_code"
+	workerExitSignal       = "signal"
+	workerExitStartFailure = "start_failure"
+	workerExitWatchdog     = "watchdog"
+)
+
+// classified termination of a measurement process
+type workerExit struct {
+	reason string
+	// exit code, 128+signal number for signals or -1 if the process did not start
+	code int
+	err  error
+}
+
+func classifyExit(err error) workerExit {
+	var exitErr *exec.ExitError
+	if err == nil {
+		return workerExit{reason: workerExitCode}
+	}
+	if !errors.As(err, &exitErr) {
+		return workerExit{reason: workerExitStartFailure, code: -1, err: err}
+	}
+	if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return workerExit{reason: workerExitSignal, code: 128 + int(ws.Signal()), err: err}
+	}
+	return workerExit{reason: workerExitCode, code: exitErr.ExitCode(), err: err}
+}
+
+func (e workerExit) String() string {
+	switch e.reason {
+	case workerExitStartFailure:
+		return fmt.Sprintf("failed to start: %v", e.err)
+	case workerExitSignal:
+		return fmt.Sprintf("terminated by %v", e.err)
+	case workerExitWatchdog:
+		return fmt.Sprintf("killed by watchdog (%v)", e.err)
+	}
+	return fmt.Sprintf("exited with code %d", e.code)
+}
+
+// exponential backoff with jitter between restarts
+type backoff struct {
+	min, max time.Duration
+	current  time.Duration
+}
+
+func (b *backoff) next() time.Duration {
+	if b.current == 0 {
+		b.current = b.min
+	} else {
+		b.current *= 2
+	}
+	if b.current > b.max {
+		b.current = b.max
+	}
+	// spread the restarts by +-20% so pairs failing together do not restart in lockstep
+	return time.Duration(float64(b.current) * (0.8 + 0.4*rand.Float64()))
+}
+
+func (b *backoff) reset() {
+	b.current = 0
+}
+
+// watchdog expecting progress (i.e. a new session summary) once per period
+type watchdog struct {
+	period    time.Duration
+	maxMissed uint64
+	progress  uint64
+	fired     uint32
+}
+
+func (wd *watchdog) notify() {
+	atomic.AddUint64(&wd.progress, 1)
+}
+
+func (wd *watchdog) hasFired() bool {
+	return atomic.LoadUint32(&wd.fired) != 0
+}
+
+// count the periods without progress and call kill after maxMissed consecutive ones,
+// the first period only starts after a grace period of one period for the process to start up
+func (wd *watchdog) run(ctx context.Context, status *WorkerStatus, kill func()) {
+	if !sleepContext(ctx, wd.period) {
+		return
+	}
+	ticker := time.NewTicker(wd.period)
+	defer ticker.Stop()
+
+	var consecutive uint64
+	last := atomic.LoadUint64(&wd.progress)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		current := atomic.LoadUint64(&wd.progress)
+		if current != last {
+			last = current
+			consecutive = 0
+			continue
+		}
+		status.recordMissed()
+		consecutive++
+		if wd.maxMissed > 0 && consecutive >= wd.maxMissed {
+			atomic.StoreUint32(&wd.fired, 1)
+			kill()
+			return
+		}
+	}
+}
+
+// implemented by backends supervising an external process
+type supervisedBackend interface {
+	Status() *WorkerStatus
+}
+
+// status of a supervised measurement process as exposed in the metrics
+type WorkerStatus struct {
+	mutex        sync.Mutex
+	up           bool
+	restarts     uint64
+	missed       uint64
+	lastExitCode int
+	exits        map[string]uint64
+
+	// number of session files and their total size by directory
+	dirFiles map[string]uint64
+	dirBytes map[string]uint64
+}
+
+func NewWorkerStatus() *WorkerStatus {
+	return &WorkerStatus{
+		exits:    make(map[string]uint64),
+		dirFiles: make(map[string]uint64),
+		dirBytes: make(map[string]uint64),
+	}
+}
+
+func (s *WorkerStatus) setUp() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.up = true
+}
+
+func (s *WorkerStatus) recordExit(exit workerExit) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.up = false
+	s.lastExitCode = exit.code
+	s.exits[exit.reason]++
+}
+
+func (s *WorkerStatus) recordMissed() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.missed++
+}
+
+func (s *WorkerStatus) setDirUsage(dir string, files []retainedFile) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var size uint64
+	for _, f := range files {
+		size += f.size
+	}
+	s.dirFiles[dir] = uint64(len(files))
+	s.dirBytes[dir] = size
+}
+
+func (s *WorkerStatus) recordRestart() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.restarts++
+}
+
+func (s *WorkerStatus) WriteMetrics(me metricEmitter, labels prometheus.Labels) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	me.add("owamp_worker_up", labels, float64(boolToInt(s.up)))
+	me.add("owamp_worker_restarts_total", labels, float64(s.restarts))
+	me.add("owamp_worker_last_exit_code", labels, float64(s.lastExitCode))
+	me.add("owamp_worker_missed_sessions_total", labels, float64(s.missed))
+	for _, reason := range []string{workerExitCode, workerExitSignal, workerExitStartFailure, workerExitWatchdog} {
+		me.add("owamp_worker_exits_total", labels, float64(s.exits[reason]), "reason", reason)
+	}
+	for dir, files := range s.dirFiles {
+		me.add("owamp_workdir_files", labels, float64(files), "dir", dir)
+		me.add("owamp_workdir_bytes", labels, float64(s.dirBytes[dir]), "dir", dir)
+	}
+}
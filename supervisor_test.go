@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	b := backoff{min: time.Second, max: 10 * time.Second}
+	// the jitter spreads each delay by +-20%
+	for _, base := range []time.Duration{1, 2, 4, 8, 10, 10} {
+		base *= time.Second
+		if d := b.next(); d < base*8/10 || d > base*12/10 {
+			t.Errorf("delay %v, want %v +-20%%", d, base)
+		}
+	}
+	b.reset()
+	if d := b.next(); d < 800*time.Millisecond || d > 1200*time.Millisecond {
+		t.Errorf("delay %v after reset, want 1s +-20%%", d)
+	}
+}
+
+func TestClassifyExit(t *testing.T) {
+	tests := []struct {
+		name   string
+		cmd    *exec.Cmd
+		reason string
+		code   int
+	}{
+		{"success", exec.Command("sh", "-c", "exit 0"), workerExitCode, 0},
+		{"exit code", exec.Command("sh", "-c", "exit 3"), workerExitCode, 3},
+		{"signal", exec.Command("sh", "-c", "kill -KILL $$"), workerExitSignal, 128 + 9},
+		{"missing command", exec.Command("/nonexistent/powstream"), workerExitStartFailure, -1},
+	}
+	for _, tt := range tests {
+		exit := classifyExit(tt.cmd.Run())
+		if exit.reason != tt.reason || exit.code != tt.code {
+			t.Errorf("%s: classified as %s with code %d (%v), want %s with code %d", tt.name, exit.reason, exit.code, exit, tt.reason, tt.code)
+		}
+	}
+}
+
+func TestWatchdog(t *testing.T) {
+	period := 20 * time.Millisecond
+
+	// killed after the grace period and the missed periods
+	status := NewWorkerStatus()
+	wd := &watchdog{period: period, maxMissed: 3}
+	killed := make(chan time.Time, 1)
+	start := time.Now()
+	go wd.run(context.Background(), status, func() { killed <- time.Now() })
+	select {
+	case at := <-killed:
+		if d := at.Sub(start); d < 4*period {
+			t.Errorf("killed after %v, want at least %v", d, 4*period)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("watchdog did not fire")
+	}
+	if !wd.hasFired() || status.missed != 3 {
+		t.Errorf("fired %v with %d missed sessions, want true with 3", wd.hasFired(), status.missed)
+	}
+
+	// progress in every period keeps the process alive
+	status = NewWorkerStatus()
+	wd = &watchdog{period: period, maxMissed: 1}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		wd.run(ctx, status, func() { t.Error("watchdog fired despite progress") })
+		close(stopped)
+	}()
+	for i := 0; i < 20; i++ {
+		wd.notify()
+		time.Sleep(period / 4)
+	}
+	cancel()
+	<-stopped
+	if wd.hasFired() || status.missed != 0 {
+		t.Errorf("fired %v with %d missed sessions, want false with 0", wd.hasFired(), status.missed)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// counters accumulating the summaries of all sessions of a measurement
+//
+// Unlike the metrics of the last session these only ever increase, so rate()
+// and increase() work on them and no session is missed by a slow scrape. A
+// session is only counted once: summaries starting no later than the last
+// counted one (e.g. backfilled again after a restart) are skipped.
+
+type MeasurementTotals struct {
+	sessions  uint64
+	sentPkts  uint64
+	lostPkts  uint64
+	dupPkts   uint64
+	lastStart OWTimestamp
+	// merged latency histogram, keys in multiples of latencyHistWidth
+	latencyHistWidth float64
+	latencyHist      map[int64]uint64
+}
+
+func NewMeasurementTotals() *MeasurementTotals {
+	return &MeasurementTotals{
+		latencyHist: make(map[int64]uint64),
+	}
+}
+
+// add a summary, returns false if the session was already counted
+func (t *MeasurementTotals) merge(s *SummaryReport) bool {
+	if !s.startTime.IsZero() {
+		if s.startTime <= t.lastStart {
+			return false
+		}
+		t.lastStart = s.startTime
+	}
+
+	t.sessions++
+	t.sentPkts += s.sentPkts
+	t.lostPkts += s.lostPkts
+	t.dupPkts += s.dupPkts
+
+	if t.latencyHistWidth == 0 {
+		t.latencyHistWidth = s.latencyHistWidth
+	}
+	for _, entry := range s.latencyHist {
+		key := entry.key
+		// the bucket width only changes with the configuration, rebin just in case
+		if s.latencyHistWidth != t.latencyHistWidth && t.latencyHistWidth > 0 {
+			key = int64(math.Round(float64(key) * s.latencyHistWidth / t.latencyHistWidth))
+		}
+		t.latencyHist[key] += entry.value
+	}
+	return true
+}
+
+// the merged latency histogram sorted by key
+func (t *MeasurementTotals) latencyHistogram() []HistogramEntry {
+	ret := make([]HistogramEntry, 0, len(t.latencyHist))
+	for key, value := range t.latencyHist {
+		ret = append(ret, HistogramEntry{key: key, value: value})
+	}
+	sort.Slice(ret, func(i int, j int) bool {
+		return ret[i].key < ret[j].key
+	})
+	return ret
+}
+
+// write the counters and the merged histogram (without timestamps, they are not tied to a session)
+func (r *Registry) writeTotals(me metricEmitter, mIdx uint, t *MeasurementTotals) {
+	mcfg := r.cfg.measurements[mIdx]
+	labels := prometheus.Labels(mcfg.labels)
+
+	me.add("owamp_sessions_total", labels, float64(t.sessions))
+	me.add("owamp_packets_sent_total", labels, float64(t.sentPkts))
+	me.add("owamp_packets_lost_total", labels, float64(t.lostPkts))
+	me.add("owamp_packets_duplicate_total", labels, float64(t.dupPkts))
+
+	hist := t.latencyHistogram()
+	if r.victoriaHistogram {
+		WriteHistogramVictoriaMetrics(me, "owamp_latency_cumulative", labels, time.Time{}, hist, t.latencyHistWidth)
+	} else {
+		WriteHistogramPrometheus(me, "owamp_latency_cumulative", labels, time.Time{}, hist, t.latencyHistWidth, mcfg.promHistBins)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMeasurementTotalsMerge(t *testing.T) {
+	totals := NewMeasurementTotals()
+	summaries := []struct {
+		summary SummaryReport
+		counted bool
+	}{
+		{SummaryReport{startTime: 100 << 32, sentPkts: 10, lostPkts: 1, latencyHistWidth: 0.001, latencyHist: []HistogramEntry{{1, 5}, {2, 4}}}, true},
+		// backfilled again after a restart
+		{SummaryReport{startTime: 100 << 32, sentPkts: 10, lostPkts: 1}, false},
+		{SummaryReport{startTime: 90 << 32, sentPkts: 10}, false},
+		// rebinned to the width of the first summary
+		{SummaryReport{startTime: 110 << 32, sentPkts: 10, dupPkts: 2, latencyHistWidth: 0.002, latencyHist: []HistogramEntry{{1, 10}}}, true},
+		// sessions without a start time can not be told apart
+		{SummaryReport{sentPkts: 5, lostPkts: 5}, true},
+	}
+	for i, s := range summaries {
+		if counted := totals.merge(&s.summary); counted != s.counted {
+			t.Errorf("summary %d: merge() = %v, want %v", i, counted, s.counted)
+		}
+	}
+
+	if totals.sessions != 3 || totals.sentPkts != 25 || totals.lostPkts != 6 || totals.dupPkts != 2 {
+		t.Errorf("got %d sessions, %d sent, %d lost, %d duplicates, want 3, 25, 6, 2",
+			totals.sessions, totals.sentPkts, totals.lostPkts, totals.dupPkts)
+	}
+	if totals.lastStart != 110<<32 {
+		t.Errorf("lastStart = %X, want %X", uint64(totals.lastStart), uint64(110<<32))
+	}
+	want := []HistogramEntry{{1, 5}, {2, 14}}
+	if got := totals.latencyHistogram(); totals.latencyHistWidth != 0.001 || !reflect.DeepEqual(got, want) {
+		t.Errorf("histogram (width %v) = %v, want %v", totals.latencyHistWidth, got, want)
+	}
+}
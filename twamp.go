@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+// TWAMP (RFC 5357), TWAMP-Light and STAMP (RFC 8762) session-sender
+//
+// The control protocol shares the connection setup with OWAMP, only the
+// Request-TW-Session message and the Stop-Sessions handling differ.
+// The sender acts as control-client, the reflector runs on the destination.
+// TWAMP-Light and STAMP do without the control connection.
+
+const (
+	twampControlPort = 862
+
+	twampCmdRequestTWSession = 5
+
+	// reflected unauthenticated test packet
+	twampReflectedPacketSize = 41
+)
+
+// delay results of a two-way measurement in addition to the forward direction
+type TwoWayReport struct {
+	roundTrip SummaryReport
+	reverse   SummaryReport
+
+	// TLV-derived information (only for STAMP sessions with TLVs)
+	stamp *STAMPReport
+}
+
+// per-packet data of a two-way session
+type twoWaySession struct {
+	forward   OWPSession
+	reverse   OWPSession
+	roundTrip OWPSession
+
+	stamp *STAMPReport
+}
+
+// timestamps of a single reflected test packet
+type reflectedPacket struct {
+	seqNo        uint32
+	sendTime     OWTimestamp // T1
+	sendErrEst   uint16
+	reflRecvTime OWTimestamp // T2
+	reflSendTime OWTimestamp // T3
+	reflErrEst   uint16
+	recvTime     OWTimestamp // T4
+	senderTTL    uint8
+
+	// anything following the base STAMP packet (i.e. TLVs)
+	tail []byte
+}
+
+// parse a reflected unauthenticated test packet (TWAMP and STAMP share the layout)
+func parseReflectedPacket(b []byte, recvTime OWTimestamp) (reflectedPacket, error) {
+	if len(b) < twampReflectedPacketSize {
+		return reflectedPacket{}, errors.New("reflected test packet too short")
+	}
+	pkt := reflectedPacket{
+		reflSendTime: OWTimestamp(binary.BigEndian.Uint64(b[4:12])),
+		reflErrEst:   binary.BigEndian.Uint16(b[12:14]),
+		reflRecvTime: OWTimestamp(binary.BigEndian.Uint64(b[16:24])),
+		seqNo:        binary.BigEndian.Uint32(b[24:28]),
+		sendTime:     OWTimestamp(binary.BigEndian.Uint64(b[28:36])),
+		sendErrEst:   binary.BigEndian.Uint16(b[36:38]),
+		senderTTL:    b[40],
+		recvTime:     recvTime,
+	}
+	if len(b) > stampPacketSize {
+		pkt.tail = append([]byte(nil), b[stampPacketSize:]...)
+	}
+	return pkt, nil
+}
+
+// split the results of the reflected packets into the forward, reverse and round-trip records
+// (packets which did not come back are accounted as lost in all of them)
+func twoWayRecords(packets map[uint32]reflectedPacket, sess *OWPSession, interval time.Duration) ([]OWPRecord, []OWPRecord, []OWPRecord) {
+	forward := make([]OWPRecord, 0, sess.numPackets)
+	reverse := make([]OWPRecord, 0, sess.numPackets)
+	roundTrip := make([]OWPRecord, 0, sess.numPackets)
+
+	start := sess.startTime.Time()
+	for seq := uint32(0); seq < sess.numPackets; seq++ {
+		pkt, ok := packets[seq]
+		if !ok {
+			lost := OWPRecord{
+				seqNo:    seq,
+				sendTime: OWTimestampFromTime(start.Add(time.Duration(seq) * interval)),
+				ttl:      owpTTLUnknown,
+			}
+			forward = append(forward, lost)
+			reverse = append(reverse, lost)
+			roundTrip = append(roundTrip, lost)
+			continue
+		}
+		forward = append(forward, OWPRecord{
+			seqNo:      seq,
+			sendTime:   pkt.sendTime,
+			sendErrEst: pkt.sendErrEst,
+			recvTime:   pkt.reflRecvTime,
+			recvErrEst: pkt.reflErrEst,
+			ttl:        pkt.senderTTL,
+		})
+		reverse = append(reverse, OWPRecord{
+			seqNo:      seq,
+			sendTime:   pkt.reflSendTime,
+			sendErrEst: pkt.reflErrEst,
+			recvTime:   pkt.recvTime,
+			recvErrEst: owampDefaultErrEstimate,
+			ttl:        owpTTLUnknown,
+		})
+		// the round-trip time excludes the time spent in the reflector
+		roundTrip = append(roundTrip, OWPRecord{
+			seqNo:      seq,
+			sendTime:   pkt.sendTime,
+			sendErrEst: owampDefaultErrEstimate,
+			recvTime:   pkt.recvTime - (pkt.reflSendTime - pkt.reflRecvTime),
+			recvErrEst: owampDefaultErrEstimate,
+			ttl:        owpTTLUnknown,
+		})
+	}
+	return forward, reverse, roundTrip
+}
+
+// send the test packets of the session and collect the reflected packets
+// (the first bytes of the packet template are overwritten with the sequence number, timestamp and error estimate)
+func runReflectedSession(conn *net.UDPConn, addr *net.UDPAddr, sess *OWPSession, interval time.Duration, packet []byte, lossTimeout time.Duration) (map[uint32]reflectedPacket, error) {
+	start := sess.startTime.Time()
+	end := start.Add(time.Duration(sess.numPackets) * interval).Add(lossTimeout)
+
+	received := make(map[uint32]reflectedPacket)
+	recvDone := make(chan struct{})
+	go func() {
+		defer close(recvDone)
+		conn.SetReadDeadline(end)
+		buf := make([]byte, 65536)
+		for {
+			n, _, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			pkt, err := parseReflectedPacket(buf[:n], OWTimestampFromTime(time.Now()))
+			if err != nil || pkt.seqNo >= sess.numPackets {
+				continue
+			}
+			if _, dup := received[pkt.seqNo]; !dup {
+				received[pkt.seqNo] = pkt
+			}
+		}
+	}()
+
+	buf := append([]byte(nil), packet...)
+	var err error
+	for seq := uint32(0); seq < sess.numPackets; seq++ {
+		time.Sleep(time.Until(start.Add(time.Duration(seq) * interval)))
+		encodeTestPacket(buf, seq, OWTimestampFromTime(time.Now()), owampDefaultErrEstimate)
+		if _, err = conn.WriteToUDP(buf, addr); err != nil {
+			err = fmt.Errorf("failed sending test packet: %v", err)
+			break
+		}
+	}
+
+	<-recvDone
+	return received, err
+}
+
+type TWAMPWorker struct {
+	measurementOut chan MeasurementReport
+	measurementIdx uint
+	cfg            Config
+	mcfg           MeasurementCfg
+}
+
+func NewTWAMPWorker(cfg Config, idx uint, outCh chan MeasurementReport) *TWAMPWorker {
+	return &TWAMPWorker{
+		measurementOut: outCh,
+		measurementIdx: idx,
+		cfg:            cfg,
+		mcfg:           cfg.measurements[idx],
+	}
+}
+
+func (w *TWAMPWorker) RunWorker(ctx context.Context) {
+	bucketWidth, err := strconv.ParseFloat(w.mcfg.bucketWidth, 64)
+	if err != nil {
+		log.Printf("%d invalid bucket width %s: %v", w.measurementIdx, w.mcfg.bucketWidth, err)
+		return
+	}
+
+	for {
+		res, err := w.runSession(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("%d %s session failed: %v", w.measurementIdx, w.mcfg.protocol, err)
+			if !sleepContext(ctx, nativeRetryDelay) {
+				return
+			}
+			continue
+		}
+
+		report := summaryMeasurementReport(w.measurementIdx, SummarizeSession(&res.forward, bucketWidth))
+		report.session = &res.forward
+		report.twoWay = &TwoWayReport{
+			roundTrip: SummarizeSession(&res.roundTrip, bucketWidth),
+			reverse:   SummarizeSession(&res.reverse, bucketWidth),
+			stamp:     res.stamp,
+		}
+		w.measurementOut <- report
+	}
+}
+
+// run a single TWAMP, TWAMP-Light or STAMP session
+func (w *TWAMPWorker) runSession(ctx context.Context) (twoWaySession, error) {
+	ret := twoWaySession{}
+	src := w.cfg.targets[w.mcfg.targetSrc]
+	dst := w.cfg.targets[w.mcfg.targetDst]
+	if !src.local {
+		return ret, errors.New("two-way measurements require the source to be local")
+	}
+
+	port := w.mcfg.port
+	if port == 0 {
+		port = twampControlPort
+	}
+	remote := net.JoinHostPort(dst.hostname, strconv.Itoa(int(port)))
+
+	interval := time.Second / time.Duration(w.mcfg.pps)
+	sess := OWPSession{
+		numPackets:  uint32(w.mcfg.duration * w.mcfg.pps),
+		startTime:   OWTimestampFromTime(time.Now().Add(nativeStartDelay)),
+		lossTimeout: uint64(nativeLossTimeout.Seconds()) << 32,
+	}
+
+	var client *OWAMPClient
+	var reflector *net.UDPAddr
+	var localIP net.IP
+	if w.mcfg.protocol == "twamp" {
+		var err error
+		client, err = DialOWAMP(remote, nativeControlTimeout)
+		if err != nil {
+			return ret, err
+		}
+		defer client.Close()
+		// abort the session when the measurement is stopped
+		stop := context.AfterFunc(ctx, func() { client.Close() })
+		defer stop()
+		localIP = client.LocalAddr().(*net.TCPAddr).IP
+		reflector = &net.UDPAddr{IP: client.RemoteAddr().(*net.TCPAddr).IP}
+	} else {
+		// TWAMP-Light and STAMP: the test packets are sent straight to the reflector
+		var err error
+		reflector, err = net.ResolveUDPAddr("udp", remote)
+		if err != nil {
+			return ret, err
+		}
+	}
+
+	network := "udp6"
+	if reflector.IP.To4() != nil {
+		network = "udp4"
+	}
+	conn, err := listenUDPInRange(network, localIP, w.cfg.portRangeMin, w.cfg.portRangeMax)
+	if err != nil {
+		return ret, err
+	}
+	defer conn.Close()
+	stopConn := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stopConn()
+	localPort := uint16(conn.LocalAddr().(*net.UDPAddr).Port)
+
+	sess.ipVersion = owampIPVersion(reflector.IP)
+	sess.senderAddr, sess.senderPort = localIP, localPort
+	sess.receiverAddr, sess.receiverPort = reflector.IP, uint16(reflector.Port)
+
+	if client != nil {
+		// the receiver port is still 0 here, the server picks the reflector port in Accept-Session
+		reflPort, sid, err := client.RequestTWSession(&sess)
+		if err != nil {
+			return ret, err
+		}
+		sess.sid = sid
+		sess.receiverPort = reflPort
+		reflector.Port = int(reflPort)
+		if err = client.StartSessions(); err != nil {
+			return ret, err
+		}
+	}
+
+	packet := make([]byte, twampReflectedPacketSize)
+	if w.mcfg.protocol == "stamp" {
+		packet = makeSTAMPPacket(w.mcfg.stampTLVs)
+	}
+	packets, err := runReflectedSession(conn, reflector, &sess, interval, packet, nativeLossTimeout)
+	if err != nil {
+		return ret, err
+	}
+
+	if client != nil {
+		if err = client.StopTWSessions(); err != nil {
+			return ret, err
+		}
+	}
+
+	if w.mcfg.protocol == "stamp" && w.mcfg.stampTLVs {
+		ret.stamp = analyzeSTAMPTLVs(packets)
+	}
+
+	sess.finished = 1
+	ret.forward, ret.reverse, ret.roundTrip = sess, sess, sess
+	ret.forward.records, ret.reverse.records, ret.roundTrip.records = twoWayRecords(packets, &sess, interval)
+	ret.reverse.senderAddr, ret.reverse.receiverAddr = sess.receiverAddr, sess.senderAddr
+	ret.reverse.senderPort, ret.reverse.receiverPort = sess.receiverPort, sess.senderPort
+	return ret, nil
+}
+
+// request a TWAMP test session, returns the reflector port and the SID
+func (client *OWAMPClient) RequestTWSession(req *OWPSession) (uint16, [16]byte, error) {
+	var sid [16]byte
+
+	// same layout as Request-Session but without schedule and trailing HMAC
+	tw := *req
+	tw.slots = nil
+	tw.numPackets = 0
+	tw.confSender, tw.confReceiver = false, false
+	msg := encodeOWPTestRequest(&tw)[:owpTestRequestSize]
+	msg[0] = twampCmdRequestTWSession
+
+	if err := client.c.write(msg); err != nil {
+		return 0, sid, err
+	}
+	resp, err := client.c.read(owampAcceptSessionSize)
+	if err != nil {
+		return 0, sid, err
+	}
+	if resp[0] != owampAcceptOK {
+		return 0, sid, owampAcceptError("session request", resp[0])
+	}
+	copy(sid[:], resp[4:20])
+	return binary.BigEndian.Uint16(resp[2:4]), sid, nil
+}
+
+// stop the sessions of the control connection, unlike OWAMP the server does not respond
+func (client *OWAMPClient) StopTWSessions() error {
+	msg := encodeStopSessions(owampAcceptOK, nil)
+	binary.BigEndian.PutUint32(msg[4:8], 1)
+	return client.c.write(msg)
+}
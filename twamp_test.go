@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseReflectedPacket(t *testing.T) {
+	b := make([]byte, stampPacketSize+8)
+	binary.BigEndian.PutUint32(b[0:4], 7)
+	binary.BigEndian.PutUint64(b[4:12], 0x3000)
+	binary.BigEndian.PutUint16(b[12:14], 0x8002)
+	binary.BigEndian.PutUint64(b[16:24], 0x2000)
+	binary.BigEndian.PutUint32(b[24:28], 5)
+	binary.BigEndian.PutUint64(b[28:36], 0x1000)
+	binary.BigEndian.PutUint16(b[36:38], 0x8001)
+	b[40] = 63
+	copy(b[stampPacketSize:], []byte{1, 2, 3, 4, 5, 6, 7, 8})
+
+	got, err := parseReflectedPacket(b, 0x4000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := reflectedPacket{
+		seqNo:        5,
+		sendTime:     0x1000,
+		sendErrEst:   0x8001,
+		reflRecvTime: 0x2000,
+		reflSendTime: 0x3000,
+		reflErrEst:   0x8002,
+		recvTime:     0x4000,
+		senderTTL:    63,
+		tail:         []byte{1, 2, 3, 4, 5, 6, 7, 8},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// TWAMP reflectors may answer with the shorter packet of RFC 5357
+	if got, err = parseReflectedPacket(b[:twampReflectedPacketSize], 0x4000); err != nil || got.tail != nil {
+		t.Errorf("TWAMP packet: got %+v, %v", got, err)
+	}
+	if _, err = parseReflectedPacket(b[:twampReflectedPacketSize-1], 0x4000); err == nil {
+		t.Error("short packet accepted")
+	}
+}
+
+func TestTwoWayRecords(t *testing.T) {
+	start := OWTimestampFromTime(time.Unix(1563845224, 0))
+	sess := OWPSession{numPackets: 2, startTime: start}
+	packets := map[uint32]reflectedPacket{
+		0: {
+			seqNo:        0,
+			sendTime:     start,
+			sendErrEst:   0x8001,
+			reflRecvTime: start + 10<<22,
+			reflSendTime: start + 11<<22,
+			reflErrEst:   0x8002,
+			recvTime:     start + 20<<22,
+			senderTTL:    64,
+		},
+	}
+	forward, reverse, roundTrip := twoWayRecords(packets, &sess, time.Second)
+
+	wantForward := []OWPRecord{
+		{seqNo: 0, sendTime: start, sendErrEst: 0x8001, recvTime: start + 10<<22, recvErrEst: 0x8002, ttl: 64},
+		{seqNo: 1, sendTime: start + 1<<32, ttl: owpTTLUnknown},
+	}
+	wantReverse := []OWPRecord{
+		{seqNo: 0, sendTime: start + 11<<22, sendErrEst: 0x8002, recvTime: start + 20<<22, recvErrEst: owampDefaultErrEstimate, ttl: owpTTLUnknown},
+		wantForward[1],
+	}
+	// the time spent in the reflector is not part of the round trip
+	wantRoundTrip := []OWPRecord{
+		{seqNo: 0, sendTime: start, sendErrEst: owampDefaultErrEstimate, recvTime: start + 19<<22, recvErrEst: owampDefaultErrEstimate, ttl: owpTTLUnknown},
+		wantForward[1],
+	}
+	if !reflect.DeepEqual(forward, wantForward) {
+		t.Errorf("forward = %+v, want %+v", forward, wantForward)
+	}
+	if !reflect.DeepEqual(reverse, wantReverse) {
+		t.Errorf("reverse = %+v, want %+v", reverse, wantReverse)
+	}
+	if !reflect.DeepEqual(roundTrip, wantRoundTrip) {
+		t.Errorf("roundTrip = %+v, want %+v", roundTrip, wantRoundTrip)
+	}
+}
+
+// TWAMP-Light sender against the built-in reflector
+func TestTWAMPLightRoundTrip(t *testing.T) {
+	_, addr := startTestReflector(t, ReflectorCfg{syncSource: stampSyncSourceNTP})
+	conn := listenTestUDP(t)
+
+	sess := OWPSession{numPackets: testPackets, startTime: OWTimestampFromTime(time.Now().Add(10 * time.Millisecond))}
+	packets, err := runReflectedSession(conn, addr, &sess, testInterval, make([]byte, twampReflectedPacketSize), 200*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packets) != testPackets {
+		t.Fatalf("got %d reflected packets, want %d", len(packets), testPackets)
+	}
+	forward, reverse, roundTrip := twoWayRecords(packets, &sess, testInterval)
+	for _, records := range [][]OWPRecord{forward, reverse, roundTrip} {
+		checkTestRecords(t, records)
+	}
+}
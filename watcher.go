@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// discovery of new session files (.sum and .owp) in a directory
+//
+// New files are reported by inotify where available, otherwise the directory
+// is polled. Files already present before the watch starts are reported
+// oldest first, unless they were marked as seen by skipExisting. Every file
+// is only reported once.
+
+const (
+	watcherPollInterval = 10 * time.Second
+	// files modified more recently than this might still be written (only relevant when scanning)
+	watcherMinFileAge = 2 * time.Second
+	// with inotify the files removed in the meantime are forgotten at most this often
+	watcherForgetInterval = 10 * time.Minute
+)
+
+var errNotifyUnsupported = errors.New("file system notifications not supported")
+
+type sessionFileWatcher struct {
+	dir        string
+	process    func(path string)
+	seen       map[string]bool
+	lastForget time.Time
+}
+
+func newSessionFileWatcher(dir string, process func(path string)) *sessionFileWatcher {
+	return &sessionFileWatcher{
+		dir:     dir,
+		process: process,
+		seen:    make(map[string]bool),
+	}
+}
+
+// watch the directory until ctx is cancelled
+func (fw *sessionFileWatcher) Run(ctx context.Context) {
+	err := fw.watchNotify(ctx)
+	if err == nil || ctx.Err() != nil {
+		return
+	}
+	log.Printf("watching %s with inotify failed, falling back to polling: %v", fw.dir, err)
+	fw.poll(ctx)
+}
+
+func (fw *sessionFileWatcher) poll(ctx context.Context) {
+	fw.scan()
+	for sleepContext(ctx, watcherPollInterval) {
+		fw.scan()
+	}
+}
+
+// mark the session files currently in the directory as seen, so only those written afterwards are reported
+func (fw *sessionFileWatcher) skipExisting() {
+	entries, err := os.ReadDir(fw.dir)
+	if err != nil {
+		log.Printf("failed to scan %s: %v", fw.dir, err)
+		return
+	}
+	for _, entry := range entries {
+		if isNewSessionFile(entry.Name()) {
+			fw.seen[entry.Name()] = true
+		}
+	}
+}
+
+// uncompressed session files as written by powstream
+func isNewSessionFile(name string) bool {
+	return strings.HasSuffix(name, ".sum") || strings.HasSuffix(name, ".owp")
+}
+
+// report a single file unless it was already seen
+func (fw *sessionFileWatcher) found(name string) {
+	if !isNewSessionFile(name) || fw.seen[name] {
+		return
+	}
+	fw.seen[name] = true
+	fw.process(filepath.Join(fw.dir, name))
+
+	// without scans the seen files would pile up forever
+	if time.Since(fw.lastForget) >= watcherForgetInterval {
+		if entries, err := os.ReadDir(fw.dir); err == nil {
+			present := make(map[string]bool, len(entries))
+			for _, entry := range entries {
+				present[entry.Name()] = true
+			}
+			fw.forget(present)
+		}
+	}
+}
+
+// forget the files which were removed in the meantime (e.g. by the retention)
+func (fw *sessionFileWatcher) forget(present map[string]bool) {
+	for name := range fw.seen {
+		if !present[name] {
+			delete(fw.seen, name)
+		}
+	}
+	fw.lastForget = time.Now()
+}
+
+// list the directory and report the new files in the order of their names (i.e. chronologically)
+func (fw *sessionFileWatcher) scan() {
+	entries, err := os.ReadDir(fw.dir)
+	if err != nil {
+		log.Printf("failed to scan %s: %v", fw.dir, err)
+		return
+	}
+
+	present := make(map[string]bool, len(entries))
+	names := make([]string, 0)
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !isNewSessionFile(entry.Name()) {
+			continue
+		}
+		present[entry.Name()] = true
+		if info, err := entry.Info(); err == nil && time.Since(info.ModTime()) < watcherMinFileAge {
+			// check again on the next scan (or notification)
+			continue
+		}
+		names = append(names, entry.Name())
+	}
+	fw.forget(present)
+
+	sort.Strings(names)
+	for _, name := range names {
+		fw.found(name)
+	}
+}
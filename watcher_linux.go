@@ -0,0 +1,65 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"syscall"
+)
+
+const inotifyEventSize = syscall.SizeofInotifyEvent
+
+// watch the directory with inotify until ctx is cancelled
+func (fw *sessionFileWatcher) watchNotify(ctx context.Context) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return err
+	}
+	// the file is non-blocking, so closing it interrupts a pending read
+	f := os.NewFile(uintptr(fd), "inotify")
+	defer f.Close()
+
+	// files are complete once closed after writing or moved into the directory
+	if _, err = syscall.InotifyAddWatch(fd, fw.dir, syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO); err != nil {
+		return err
+	}
+	// only scan once the watch is established, so no file can be missed
+	fw.scan()
+
+	go func() {
+		<-ctx.Done()
+		f.Close()
+	}()
+
+	buf := make([]byte, 64*(inotifyEventSize+syscall.NAME_MAX+1))
+	for {
+		n, err := f.Read(buf)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		for off := 0; off+inotifyEventSize <= n; {
+			mask := binary.NativeEndian.Uint32(buf[off+4 : off+8])
+			nameLen := int(binary.NativeEndian.Uint32(buf[off+12 : off+16]))
+			end := off + inotifyEventSize + nameLen
+			if end > n {
+				break
+			}
+			name := string(bytes.TrimRight(buf[off+inotifyEventSize:end], "\x00"))
+			off = end
+
+			if mask&syscall.IN_Q_OVERFLOW != 0 {
+				// events were lost, look for the files ourselves
+				fw.scan()
+				continue
+			}
+			fw.found(name)
+		}
+	}
+}
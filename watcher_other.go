@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import (
+	"context"
+)
+
+// inotify is only available on Linux, the watcher falls back to polling elsewhere
+func (fw *sessionFileWatcher) watchNotify(ctx context.Context) error {
+	return errNotifyUnsupported
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSessionFileWatcherSkipExisting(t *testing.T) {
+	dir := t.TempDir()
+	writeTestSessionFile(t, dir, "1_2.owp", 0, time.Minute)
+	writeTestSessionFile(t, dir, "1_2.sum", 0, time.Minute)
+
+	var processed []string
+	fw := newSessionFileWatcher(dir, func(path string) {
+		processed = append(processed, filepath.Base(path))
+	})
+	fw.skipExisting()
+	fw.scan()
+	if len(processed) != 0 {
+		t.Errorf("existing files %v reported", processed)
+	}
+
+	// the files written afterwards are reported oldest first, each only once
+	writeTestSessionFile(t, dir, "3_4.sum", 0, time.Minute)
+	writeTestSessionFile(t, dir, "2_3.sum", 0, time.Minute)
+	writeTestSessionFile(t, dir, "2_3.txt", 0, time.Minute)
+	fw.scan()
+	fw.scan()
+	if want := []string{"2_3.sum", "3_4.sum"}; !reflect.DeepEqual(processed, want) {
+		t.Errorf("reported %v, want %v", processed, want)
+	}
+}
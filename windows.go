@@ -0,0 +1,224 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// aggregates over the sessions of a measurement in sliding time windows
+//
+// A bounded history of the recent summaries is kept per measurement, only the
+// values needed for the aggregates are copied. A session belongs to a window
+// if it ended within the window length before the scrape. The history is kept
+// in the state file if configured.
+
+// upper bound of the sessions kept per measurement, independent of the window lengths
+const maxWindowSessions = 20000
+
+// quantiles derived from the merged latency histogram of a window
+var windowQuantiles = []float64{0.5, 0.9, 0.95, 0.99}
+
+type WindowCfg struct {
+	// as given in the configuration, used as window label
+	name   string
+	length time.Duration
+}
+
+type windowSession struct {
+	startTime        OWTimestamp
+	endTime          time.Time
+	sentPkts         uint64
+	lostPkts         uint64
+	dupPkts          uint64
+	latencyMin       float64
+	latencyMax       float64
+	latencyHistWidth float64
+	latencyHist      []HistogramEntry
+}
+
+type MeasurementHistory struct {
+	// ordered by end time, oldest first
+	sessions []windowSession
+}
+
+// add a summary, returns false if the session is already in the history
+func (h *MeasurementHistory) add(s *SummaryReport, metricsTimestamp OWTimestamp) bool {
+	if n := len(h.sessions); n > 0 && !s.startTime.IsZero() && s.startTime <= h.sessions[n-1].startTime {
+		return false
+	}
+	end := s.endTime.Time()
+	if s.endTime.IsZero() {
+		end = metricsTimestamp.Time()
+	}
+	h.sessions = append(h.sessions, windowSession{
+		startTime:        s.startTime,
+		endTime:          end,
+		sentPkts:         s.sentPkts,
+		lostPkts:         s.lostPkts,
+		dupPkts:          s.dupPkts,
+		latencyMin:       s.latencyMin,
+		latencyMax:       s.latencyMax,
+		latencyHistWidth: s.latencyHistWidth,
+		latencyHist:      append([]HistogramEntry(nil), s.latencyHist...),
+	})
+	if len(h.sessions) > maxWindowSessions {
+		h.sessions = h.sessions[len(h.sessions)-maxWindowSessions:]
+	}
+	return true
+}
+
+// drop the sessions which ended before the given time
+func (h *MeasurementHistory) prune(before time.Time) {
+	i := sort.Search(len(h.sessions), func(i int) bool {
+		return !h.sessions[i].endTime.Before(before)
+	})
+	// copy so the dropped histograms can be freed
+	h.sessions = append([]windowSession(nil), h.sessions[i:]...)
+}
+
+type windowAggregate struct {
+	sessions         uint64
+	sentPkts         uint64
+	lostPkts         uint64
+	dupPkts          uint64
+	latencyMin       float64
+	latencyMax       float64
+	latencyHistWidth float64
+	latencyHist      map[int64]uint64
+}
+
+// merge the sessions which ended after the given time
+func (h *MeasurementHistory) aggregate(after time.Time) windowAggregate {
+	agg := windowAggregate{
+		latencyMin:  math.Inf(1),
+		latencyMax:  math.Inf(-1),
+		latencyHist: make(map[int64]uint64),
+	}
+	for i := len(h.sessions) - 1; i >= 0 && h.sessions[i].endTime.After(after); i-- {
+		s := &h.sessions[i]
+		agg.sessions++
+		agg.sentPkts += s.sentPkts
+		agg.lostPkts += s.lostPkts
+		agg.dupPkts += s.dupPkts
+		// sessions without received packets have no meaningful latency
+		if s.sentPkts > s.lostPkts {
+			agg.latencyMin = math.Min(agg.latencyMin, s.latencyMin)
+			agg.latencyMax = math.Max(agg.latencyMax, s.latencyMax)
+		}
+		if agg.latencyHistWidth == 0 {
+			agg.latencyHistWidth = s.latencyHistWidth
+		}
+		for _, entry := range s.latencyHist {
+			key := entry.key
+			// the bucket width only changes with the configuration, rebin just in case
+			if s.latencyHistWidth != agg.latencyHistWidth && agg.latencyHistWidth > 0 {
+				key = int64(math.Round(float64(key) * s.latencyHistWidth / agg.latencyHistWidth))
+			}
+			agg.latencyHist[key] += entry.value
+		}
+	}
+	return agg
+}
+
+// the merged latency histogram sorted by key
+func (agg *windowAggregate) latencyHistogram() []HistogramEntry {
+	ret := make([]HistogramEntry, 0, len(agg.latencyHist))
+	for key, value := range agg.latencyHist {
+		ret = append(ret, HistogramEntry{key: key, value: value})
+	}
+	sort.Slice(ret, func(i int, j int) bool {
+		return ret[i].key < ret[j].key
+	})
+	return ret
+}
+
+// latency below which the given fraction of the packets lies (upper bound of the bucket), false if there are no samples
+func (agg *windowAggregate) latencyQuantile(hist []HistogramEntry, q float64) (float64, bool) {
+	var total uint64
+	for _, entry := range hist {
+		total += entry.value
+	}
+	if total == 0 {
+		return 0, false
+	}
+	rank := uint64(math.Ceil(q * float64(total)))
+	var cumsum uint64
+	for _, entry := range hist {
+		cumsum += entry.value
+		if cumsum >= rank {
+			return float64(entry.key+1) * agg.latencyHistWidth, true
+		}
+	}
+	return float64(hist[len(hist)-1].key+1) * agg.latencyHistWidth, true
+}
+
+// longest configured window, the history is not kept beyond it
+func (cfg *Config) maxWindowLength() time.Duration {
+	var ret time.Duration
+	for _, window := range cfg.windows {
+		if window.length > ret {
+			ret = window.length
+		}
+	}
+	return ret
+}
+
+// add the summary of a report to the history of its measurement, the mutex has to be held
+func (r *Registry) addToHistory(report MeasurementReport) {
+	maxLength := r.cfg.maxWindowLength()
+	if maxLength == 0 {
+		delete(r.histories, report.measurementIdx)
+		return
+	}
+	h := r.histories[report.measurementIdx]
+	if h == nil {
+		h = &MeasurementHistory{}
+		r.histories[report.measurementIdx] = h
+	}
+	h.add(report.summary, report.metricsTimestamp)
+	h.prune(time.Now().Add(-maxLength))
+}
+
+// write the aggregates of all configured windows (without timestamps, they move with the scrape)
+func (r *Registry) writeWindows(me metricEmitter, mIdx uint, h *MeasurementHistory, now time.Time) {
+	mcfg := r.cfg.measurements[mIdx]
+	for _, window := range r.cfg.windows {
+		labels := withLabels(prometheus.Labels(mcfg.labels), "window", window.name)
+		agg := h.aggregate(now.Add(-window.length))
+
+		me.add("owamp_window_sessions", labels, float64(agg.sessions))
+		if agg.sessions == 0 {
+			continue
+		}
+		me.add("owamp_window_packets_sent", labels, float64(agg.sentPkts))
+		me.add("owamp_window_packets_lost", labels, float64(agg.lostPkts))
+		me.add("owamp_window_packets_dup", labels, float64(agg.dupPkts))
+		if agg.sentPkts > 0 {
+			me.add("owamp_window_loss_ratio", labels, float64(agg.lostPkts)/float64(agg.sentPkts))
+		}
+
+		hist := agg.latencyHistogram()
+		if r.victoriaHistogram {
+			WriteHistogramVictoriaMetrics(me, "owamp_window_latency", labels, time.Time{}, hist, agg.latencyHistWidth)
+		} else {
+			WriteHistogramPrometheus(me, "owamp_window_latency", labels, time.Time{}, hist, agg.latencyHistWidth, mcfg.promHistBins)
+		}
+
+		if !math.IsInf(agg.latencyMin, 1) {
+			me.add("owamp_window_latency_min", labels, agg.latencyMin)
+			me.add("owamp_window_latency_max", labels, agg.latencyMax)
+		}
+		if median, found := agg.latencyQuantile(hist, 0.5); found {
+			me.add("owamp_window_latency_median", labels, median)
+		}
+		for _, q := range windowQuantiles {
+			if value, found := agg.latencyQuantile(hist, q); found {
+				me.add("owamp_window_latency_quantile", labels, value, "quantile", strconv.FormatFloat(q, 'g', -1, 64))
+			}
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMeasurementHistory(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	ts := func(ago time.Duration) OWTimestamp {
+		return OWTimestampFromTime(now.Add(-ago))
+	}
+
+	h := &MeasurementHistory{}
+	summaries := []struct {
+		summary SummaryReport
+		added   bool
+	}{
+		{SummaryReport{startTime: ts(50 * time.Minute), endTime: ts(49 * time.Minute), sentPkts: 10, lostPkts: 2,
+			latencyMin: 0.001, latencyMax: 0.009, latencyHistWidth: 0.001, latencyHist: []HistogramEntry{{1, 4}, {8, 4}}}, true},
+		// already in the history
+		{SummaryReport{startTime: ts(50 * time.Minute), endTime: ts(49 * time.Minute), sentPkts: 10}, false},
+		{SummaryReport{startTime: ts(5 * time.Minute), endTime: ts(4 * time.Minute), sentPkts: 10, dupPkts: 1,
+			latencyMin: 0.002, latencyMax: 0.003, latencyHistWidth: 0.002, latencyHist: []HistogramEntry{{1, 10}}}, true},
+		// everything lost, the latency extremes are not looked at
+		{SummaryReport{startTime: ts(2 * time.Minute), endTime: ts(time.Minute), sentPkts: 10, lostPkts: 10}, true},
+	}
+	for i, s := range summaries {
+		if added := h.add(&s.summary, 0); added != s.added {
+			t.Errorf("summary %d: add() = %v, want %v", i, added, s.added)
+		}
+	}
+
+	agg := h.aggregate(now.Add(-10 * time.Minute))
+	if agg.sessions != 2 || agg.sentPkts != 20 || agg.lostPkts != 10 || agg.dupPkts != 1 {
+		t.Errorf("10m window: got %d sessions, %d sent, %d lost, %d duplicates, want 2, 20, 10, 1",
+			agg.sessions, agg.sentPkts, agg.lostPkts, agg.dupPkts)
+	}
+	if agg.latencyMin != 0.002 || agg.latencyMax != 0.003 {
+		t.Errorf("10m window: latency %v - %v, want 0.002 - 0.003", agg.latencyMin, agg.latencyMax)
+	}
+
+	// the newest session determines the width, the older one is rebinned
+	agg = h.aggregate(now.Add(-time.Hour))
+	want := []HistogramEntry{{1, 14}, {4, 4}}
+	if got := agg.latencyHistogram(); agg.latencyHistWidth != 0.002 || !reflect.DeepEqual(got, want) {
+		t.Errorf("1h window: histogram (width %v) = %v, want %v", agg.latencyHistWidth, got, want)
+	}
+
+	h.prune(now.Add(-10 * time.Minute))
+	if len(h.sessions) != 2 {
+		t.Errorf("%d sessions left after pruning, want 2", len(h.sessions))
+	}
+	if agg = h.aggregate(now); agg.sessions != 0 || !math.IsInf(agg.latencyMin, 1) {
+		t.Errorf("empty window: got %d sessions, latency min %v", agg.sessions, agg.latencyMin)
+	}
+}
+
+func TestMeasurementHistoryLimit(t *testing.T) {
+	h := &MeasurementHistory{}
+	for i := 1; i <= maxWindowSessions+10; i++ {
+		h.add(&SummaryReport{startTime: OWTimestamp(i) << 32, endTime: OWTimestamp(i+1) << 32}, 0)
+	}
+	if len(h.sessions) != maxWindowSessions {
+		t.Fatalf("history has %d sessions, want %d", len(h.sessions), maxWindowSessions)
+	}
+	if start := h.sessions[0].startTime; start != 11<<32 {
+		t.Errorf("oldest session starts at %X, want %X", uint64(start), uint64(11<<32))
+	}
+}
+
+func TestLatencyQuantile(t *testing.T) {
+	agg := windowAggregate{latencyHistWidth: 0.001}
+	hist := []HistogramEntry{{-1, 1}, {2, 49}, {5, 40}, {9, 10}}
+	tests := []struct {
+		q    float64
+		want float64
+	}{
+		{0, 0},
+		{0.01, 0},
+		{0.5, 0.003},
+		{0.9, 0.006},
+		{0.95, 0.010},
+		{1, 0.010},
+	}
+	for _, tt := range tests {
+		got, found := agg.latencyQuantile(hist, tt.q)
+		if !found || !floatEqual(got, tt.want) {
+			t.Errorf("quantile %v = %v (found %v), want %v", tt.q, got, found, tt.want)
+		}
+	}
+
+	if _, found := agg.latencyQuantile(nil, 0.5); found {
+		t.Error("quantile of an empty histogram found")
+	}
+}
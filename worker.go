@@ -3,45 +3,61 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
+	"syscall"
 	"time"
 )
 
+// subdirectory of the work directory for files which failed to parse
+const quarantineDir = "quarantine"
+
 type Worker struct {
 	measurementOut chan MeasurementReport
 	measurementIdx uint
 	workDir        string
 	cfg            Config
 	mcfg           MeasurementCfg
-}
-
-type MeasurementReport struct {
-	measurementIdx   uint
-	summary          SummaryReport
-	metricsTimestamp float64
+	status         *WorkerStatus
+	retention      *workDirRetention
 }
 
 func NewWorker(cfg Config, idx uint, outCh chan MeasurementReport) *Worker {
 	mcfg := cfg.measurements[idx]
 
-	workDir := filepath.Join(cfg.baseWorkDir, fmt.Sprintf("%s_%s", mcfg.targetSrc, mcfg.targetDst))
+	pairName := fmt.Sprintf("%s_%s", mcfg.targetSrc, mcfg.targetDst)
+	workDir := filepath.Join(cfg.baseWorkDir, pairName)
+	if mcfg.workDir != "" {
+		workDir = mcfg.workDir
+	}
 	err := os.MkdirAll(workDir, 0750)
 	if err != nil {
 		log.Fatal(err)
 	}
+	archiveDir := ""
+	if cfg.retention.archiveDir != "" {
+		archiveDir = filepath.Join(cfg.retention.archiveDir, pairName)
+		if err = os.MkdirAll(archiveDir, 0750); err != nil {
+			log.Fatal(err)
+		}
+	}
 
+	status := NewWorkerStatus()
 	return &Worker{
 		workDir:        workDir,
 		measurementOut: outCh,
 		measurementIdx: idx,
 		cfg:            cfg,
 		mcfg:           mcfg,
+		status:         status,
+		retention:      newWorkDirRetention(cfg.retention, workDir, archiveDir, status),
 	}
 }
 
@@ -53,7 +69,42 @@ func printErrorMsgs(instancePrefix string, r io.Reader) {
 	}
 }
 
-func (w *Worker) RunWorker() {
+func (w *Worker) RunWorker(ctx context.Context) {
+	// clean up what is left over from previous runs
+	w.retention.refresh()
+
+	// load the newest sessions left from before the start, the watcher skips all of them
+	w.backfill()
+
+	// in watch mode the session files are discovered in the work directory instead of powstream's output
+	if w.mcfg.discovery == "watch" {
+		go w.newWatcher().Run(ctx)
+	}
+
+	restartDelay := backoff{min: workerBackoffMin, max: workerBackoffMax}
+	for {
+		started := time.Now()
+		exit := w.runPowstream(ctx)
+		w.status.recordExit(exit)
+		if ctx.Err() != nil {
+			return
+		}
+
+		// powstream is supposed to run forever, so restart it after some delay
+		if time.Since(started) >= workerStableRuntime {
+			restartDelay.reset()
+		}
+		delay := restartDelay.next()
+		log.Printf("%d powstream %v, restarting in %v", w.measurementIdx, exit, delay.Round(time.Second))
+		if !sleepContext(ctx, delay) {
+			return
+		}
+		w.status.recordRestart()
+	}
+}
+
+// run powstream until it exits or ctx is cancelled
+func (w *Worker) runPowstream(ctx context.Context) workerExit {
 	srcHostname := w.cfg.targets[w.mcfg.targetSrc].hostname
 	destHostname := w.cfg.targets[w.mcfg.targetDst].hostname
 
@@ -94,24 +145,37 @@ func (w *Worker) RunWorker() {
 
 	log.Printf("Running %v", cmdArgs)
 
-	cmd := exec.Command(w.cfg.powstreamCmd, cmdArgs...)
+	// powstream is asked to terminate when the measurement is stopped or the watchdog fires
+	// and killed if it did not exit within the stop timeout
+	procCtx, kill := context.WithCancel(ctx)
+	defer kill()
+	cmd := exec.CommandContext(procCtx, w.cfg.powstreamCmd, cmdArgs...)
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(syscall.SIGTERM)
+	}
+	cmd.WaitDelay = w.cfg.stopTimeout
 
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		log.Printf("%d failed start stdout-pipe: %v", w.measurementIdx, err)
-		return
+		return classifyExit(err)
 	}
 
 	stderr, err := cmd.StderrPipe()
 	if err != nil {
-		log.Printf("%d failed start stderr-pipe: %v", w.measurementIdx, err)
-		return
+		return classifyExit(err)
 	}
 
 	if err := cmd.Start(); err != nil {
-		log.Printf("%d failed start: %v", w.measurementIdx, err)
-		return
+		return classifyExit(err)
+	}
+	w.status.setUp()
+
+	// every session should produce a summary
+	wd := &watchdog{
+		period:    time.Duration(w.mcfg.duration) * time.Second,
+		maxMissed: w.mcfg.watchdogMissed,
 	}
+	go wd.run(procCtx, w.status, kill)
 
 	s := bufio.NewScanner(stdout)
 	go printErrorMsgs("powstream", stderr)
@@ -120,30 +184,161 @@ func (w *Worker) RunWorker() {
 		line := strings.TrimSpace(s.Text())
 
 		if strings.HasSuffix(line, ".sum") {
+			wd.notify()
+		}
+		if w.mcfg.discovery == "watch" {
+			continue
+		}
+		if strings.HasSuffix(line, ".sum") || strings.HasSuffix(line, ".owp") {
 			// launch process to parse the file
-			go ParseSummaryFile(w.measurementOut, w.measurementIdx, line)
+			go w.processFile(line)
+		}
+	}
+
+	// if we are here means the process must have exited
+	exit := classifyExit(cmd.Wait())
+	if wd.hasFired() {
+		exit.reason = workerExitWatchdog
+	}
+	return exit
+}
+
+// parse a session file written by powstream and apply the retention once it was parsed
+func (w *Worker) processFile(path string) {
+	var err error
+	if strings.HasSuffix(path, ".sum") {
+		err = ParseSummaryFile(w.measurementOut, w.measurementIdx, path)
+	} else {
+		err = ParseDataFile(w.measurementOut, w.measurementIdx, path)
+	}
+	if err != nil {
+		w.quarantine(path, err)
+		return
+	}
+	w.retention.done(path)
+}
+
+// move a file which failed to parse into the quarantine directory, recording the error next to it
+func (w *Worker) quarantine(path string, parseErr error) {
+	dir := filepath.Join(w.workDir, quarantineDir)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		log.Printf("%d failed to create quarantine directory: %v", w.measurementIdx, err)
+		return
+	}
+	dst := filepath.Join(dir, filepath.Base(path))
+	if err := os.Rename(path, dst); err != nil {
+		log.Printf("%d failed to quarantine %s: %v", w.measurementIdx, path, err)
+		return
+	}
+	if err := os.WriteFile(dst+".error", []byte(parseErr.Error()+"\n"), 0640); err != nil {
+		log.Printf("%d failed to record error of %s: %v", w.measurementIdx, dst, err)
+	}
+}
+
+// watcher of the work directory, the files left from before the start are only loaded by the backfill
+func (w *Worker) newWatcher() *sessionFileWatcher {
+	fw := newSessionFileWatcher(w.workDir, w.processFile)
+	fw.skipExisting()
+	return fw
+}
+
+// load the newest valid sessions left in the work directory (e.g. from before a restart)
+func (w *Worker) backfill() {
+	if w.cfg.backfillSessions == 0 {
+		return
+	}
+	entries, err := os.ReadDir(w.workDir)
+	if err != nil {
+		log.Printf("%d failed to scan %s for backfill: %v", w.measurementIdx, w.workDir, err)
+		return
+	}
+	names := make(map[string]bool)
+	summaries := make([]string, 0)
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !isNewSessionFile(entry.Name()) {
+			continue
+		}
+		names[entry.Name()] = true
+		if strings.HasSuffix(entry.Name(), ".sum") {
+			summaries = append(summaries, entry.Name())
+		}
+	}
+	// the file names start with the session start time
+	sort.Sort(sort.Reverse(sort.StringSlice(summaries)))
+
+	// pick the newest sessions with a valid summary, the invalid ones are quarantined on the way
+	sessions := make([]string, 0, w.cfg.backfillSessions)
+	parsed := make([]SummaryReport, 0, w.cfg.backfillSessions)
+	for _, name := range summaries {
+		if uint64(len(sessions)) >= w.cfg.backfillSessions {
+			break
+		}
+		path := filepath.Join(w.workDir, name)
+		summary, err := readSummaryFile(path)
+		if err != nil {
+			log.Printf("%d failed parse of %s: %v", w.measurementIdx, path, err)
+			w.measurementOut <- parseErrorReport(w.measurementIdx, err)
+			w.quarantine(path, err)
+			continue
+		}
+		sessions = append(sessions, sessionName(name))
+		parsed = append(parsed, summary)
+	}
+
+	// load them oldest first, so the newest one ends up as the current report
+	for i := len(sessions) - 1; i >= 0; i-- {
+		w.measurementOut <- summaryMeasurementReport(w.measurementIdx, parsed[i])
+		w.retention.done(filepath.Join(w.workDir, sessions[i]+".sum"))
+		if names[sessions[i]+".owp"] {
+			w.processFile(filepath.Join(w.workDir, sessions[i]+".owp"))
 		}
 	}
+	if len(sessions) > 0 {
+		log.Printf("%d loaded %d sessions from %s", w.measurementIdx, len(sessions), w.workDir)
+	}
+}
+
+func (w *Worker) Status() *WorkerStatus {
+	return w.status
+}
+
+func readSummaryFile(path string) (SummaryReport, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return SummaryReport{}, err
+	}
+	return ParseSummary(bufio.NewReader(bytes.NewReader(data)))
+}
 
-	// if we are here means the process must have exited.. so restart after some delay
-	time.Sleep(30 * time.Second)
-	w.RunWorker()
+func ParseSummaryFile(out chan MeasurementReport, idx uint, path string) error {
+	summary, err := readSummaryFile(path)
+	if err != nil {
+		// a partial summary must not replace the last good report
+		log.Printf("%d failed parse of %s: %v", idx, path, err)
+		out <- parseErrorReport(idx, err)
+		return err
+	}
+	out <- summaryMeasurementReport(idx, summary)
+	return nil
 }
 
-func ParseSummaryFile(out chan MeasurementReport, idx uint, path string) {
+func ParseDataFile(out chan MeasurementReport, idx uint, path string) error {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		log.Printf("%d failed read of %s: %v", idx, path, err)
-		return
+		out <- MeasurementReport{measurementIdx: idx, parseError: owpErrRead}
+		return err
 	}
-	r := bufio.NewReader(bytes.NewReader(data))
-	summary, err := ParseSummary(r)
+	session, err := ParseOWPFile(data)
 	if err != nil {
 		log.Printf("%d failed parse of %s: %v", idx, path, err)
+		out <- MeasurementReport{measurementIdx: idx, parseError: owpErrInvalid}
+		return err
 	}
 	out <- MeasurementReport{
 		measurementIdx:   idx,
-		summary:          summary,
-		metricsTimestamp: (summary.startTime + summary.endTime) / 2,
+		session:          &session,
+		metricsTimestamp: session.startTime,
 	}
+	return nil
 }
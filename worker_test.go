@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// write a shell script standing in for powstream
+func writeTestPowstream(t *testing.T, dir string, script string) string {
+	t.Helper()
+	path := filepath.Join(dir, "powstream")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// configuration of a powstream measurement, the powstream command is set by the test
+func testWorkerConfig(t *testing.T) Config {
+	return Config{
+		baseWorkDir:  t.TempDir(),
+		stopTimeout:  200 * time.Millisecond,
+		portRangeMin: 9000,
+		portRangeMax: 9010,
+		targets: map[string]TargetCfg{
+			"src": {hostname: "127.0.0.1", local: true},
+			"dst": {hostname: "127.0.0.1"},
+		},
+		measurements: map[uint]MeasurementCfg{
+			0: {targetSrc: "src", targetDst: "dst", pps: 1, duration: 10, bucketWidth: "0.0001"},
+		},
+	}
+}
+
+// wait for the file written by the fake powstream and return its content
+func waitTestFile(t *testing.T, path string) string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		data, err := os.ReadFile(path)
+		if err == nil && strings.HasSuffix(string(data), "\n") {
+			return strings.TrimSpace(string(data))
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s not written", path)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// powstream ignoring SIGTERM is killed and reaped after the stop timeout
+func TestWorkerStopTimeout(t *testing.T) {
+	cfg := testWorkerConfig(t)
+	pidFile := filepath.Join(cfg.baseWorkDir, "pid")
+	cfg.powstreamCmd = writeTestPowstream(t, cfg.baseWorkDir, "trap '' TERM\necho $$ > "+pidFile+"\nwhile :; do sleep 0.1; done\n")
+
+	w := NewWorker(cfg, 0, make(chan MeasurementReport))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		w.RunWorker(ctx)
+		close(done)
+	}()
+	pid, err := strconv.Atoi(waitTestFile(t, pidFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("worker did not return after the stop timeout")
+	}
+	// the process is neither running nor left as zombie
+	if err := syscall.Kill(pid, 0); !errors.Is(err, syscall.ESRCH) {
+		t.Errorf("powstream process %d still exists: %v", pid, err)
+	}
+}
+
+// powstream not writing any session summaries is killed by the watchdog
+func TestWorkerWatchdog(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for the grace period and a missed session of one second each")
+	}
+	cfg := testWorkerConfig(t)
+	cfg.powstreamCmd = writeTestPowstream(t, cfg.baseWorkDir, "while :; do sleep 0.1; done\n")
+	mcfg := cfg.measurements[0]
+	mcfg.duration, mcfg.watchdogMissed = 1, 1
+	cfg.measurements[0] = mcfg
+
+	w := NewWorker(cfg, 0, make(chan MeasurementReport))
+	exit := w.runPowstream(context.Background())
+	if exit.reason != workerExitWatchdog {
+		t.Errorf("powstream %v, want killed by the watchdog", exit)
+	}
+	if w.status.missed != 1 {
+		t.Errorf("%d missed sessions, want 1", w.status.missed)
+	}
+}
+
+// only the newest sessions are loaded on startup, in watch mode the older ones are not processed either
+func TestWorkerBackfill(t *testing.T) {
+	for _, discovery := range []string{"stdout", "watch"} {
+		cfg := testWorkerConfig(t)
+		cfg.powstreamCmd = writeTestPowstream(t, cfg.baseWorkDir, "while :; do sleep 0.1; done\n")
+		cfg.backfillSessions = 2
+		mcfg := cfg.measurements[0]
+		mcfg.discovery = discovery
+		cfg.measurements[0] = mcfg
+
+		out := make(chan MeasurementReport, 10)
+		w := NewWorker(cfg, 0, out)
+		// old enough to be processed by a scan of the watcher
+		modTime := time.Now().Add(-time.Minute)
+		for i := 1; i <= 5; i++ {
+			path := filepath.Join(w.workDir, fmt.Sprintf("E0F1A2B%d00000000_E0F1A2C%d00000000.sum", i, i))
+			summary := strings.Replace(testSummary, "SENT\t100", "SENT\t"+strconv.Itoa(i), 1)
+			if err := os.WriteFile(path, []byte(summary), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(path, modTime, modTime); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			w.RunWorker(ctx)
+			close(done)
+		}()
+		// give the watcher the time for its first scan
+		time.Sleep(200 * time.Millisecond)
+		cancel()
+		<-done
+
+		close(out)
+		var sent []uint64
+		for report := range out {
+			sent = append(sent, report.summary.sentPkts)
+		}
+		if want := []uint64{4, 5}; !reflect.DeepEqual(sent, want) {
+			t.Errorf("%s: loaded sessions with %v packets sent, want %v", discovery, sent, want)
+		}
+	}
+}